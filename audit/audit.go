@@ -2,12 +2,15 @@
 package audit // import "github.com/teamwork/middleware/audit"
 
 import (
+	"bytes"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -36,11 +39,42 @@ type Auditor interface {
 
 // Options for the middleware.
 type Options struct {
-	Auditor        Auditor
-	Methods        []string
-	IgnorePaths    []string
+	Auditor     Auditor
+	Methods     []string
+	IgnorePaths []string
+
+	// FilteredFields are replaced with "[FILTERED]" in the request headers,
+	// query and form params, and JSON, form-encoded, or multipart request
+	// bodies. Matching is case-insensitive. JSON and multipart bodies which are
+	// cut off by MaxSize end after the last complete value.
+	//
+	// A name like "password" matches the header or param name, and the field
+	// at any depth in the body. Names can contain "*" and "?" globs, e.g.
+	// "*_token"; other characters are matched literally, so "user[password]"
+	// matches that form field.
+	//
+	// Patterns starting with "$" are JSONPath-like, and match a specific path
+	// in the body:
+	//
+	//	$.user.password     nested field
+	//	$.cards[*].number   field in all array elements
+	//	$.cards[0].number   field in the first array element
+	//	$..token            field at any depth
+	//	$['x.y']            field with a dot in the name
+	//
+	// Names in paths can be globs too, e.g. "$.user.api*". Headers and params
+	// are matched as top-level fields.
 	FilteredFields []string
 
+	// FilteredValues are replaced with "[FILTERED]" in all values, including
+	// bodies which aren't JSON or form-encoded; for example PatternCreditCard.
+	FilteredValues []*regexp.Regexp
+
+	// FilterValue is called for all values after FilteredValues, for values
+	// which can't be matched with just a regexp; for example
+	// FilterCreditCards.
+	FilterValue func(string) string
+
 	// MaxSize sets the maximum size to read in bytes for the request body and
 	// form params.
 	MaxSize int64
@@ -51,6 +85,8 @@ type Options struct {
 	SkipRequestBody    bool
 	// Option to not include raw request data with the log
 	SkipLogRawBody bool
+
+	redact *redactor
 }
 
 // Audit entry.
@@ -142,6 +178,14 @@ func Do(opts Options) func(http.Handler) http.Handler {
 	if opts.Auditor == nil {
 		panic("middleware/audit: Auditor is nil")
 	}
+	if opts.filters() {
+		var err error
+		opts.redact, err = newRedactor(opts.FilteredFields, opts.FilteredValues)
+		if err != nil {
+			panic(err)
+		}
+		opts.redact.fn = opts.FilterValue
+	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -151,7 +195,16 @@ func Do(opts Options) func(http.Handler) http.Handler {
 	}
 }
 
+// filters reports if any of the filter options are set.
+func (opts Options) filters() bool {
+	return len(opts.FilteredFields) > 0 || len(opts.FilteredValues) > 0 || opts.FilterValue != nil
+}
+
 // Middleware is the actual implementation.
+//
+// The parsed FilteredFields are cached by the fields and FilteredValues, so the
+// Options should be long-lived rather than created with new regexps for every
+// request.
 func Middleware(opts Options, r *http.Request) {
 	if len(opts.Methods) > 0 && !sliceutil.Contains(opts.Methods, r.Method) {
 		return
@@ -161,6 +214,17 @@ func Middleware(opts Options, r *http.Request) {
 		return
 	}
 
+	// Don't log anything if the filters are invalid, as it may leak secrets.
+	if opts.redact == nil && opts.filters() {
+		var err error
+		opts.redact, err = cachedRedactor(opts.FilteredFields, opts.FilteredValues)
+		if err != nil {
+			opts.Auditor.Log(r, err)
+			return
+		}
+		opts.redact.fn = opts.FilterValue
+	}
+
 	a := &Audit{
 		InstallationID: opts.Auditor.InstallationID(r),
 		UserID:         opts.Auditor.UserID(r),
@@ -202,7 +266,7 @@ func Middleware(opts Options, r *http.Request) {
 		a.RequestBody = b
 	}
 
-	if len(opts.FilteredFields) > 0 {
+	if opts.redact != nil {
 		a.filterFields(r, opts)
 	}
 
@@ -210,47 +274,71 @@ func Middleware(opts Options, r *http.Request) {
 }
 
 func (a *Audit) filterFields(r *http.Request, opts Options) {
-	body := make(map[string]interface{})
-	bodyIsJSON := strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "application/json")
+	rd := opts.redact
+
+	// The headers and form are shared with the request.
+	a.RequestHeaders.Header = a.RequestHeaders.Header.Clone()
+	if a.FormParams.Values != nil {
+		form := make(url.Values, len(a.FormParams.Values))
+		for k, v := range a.FormParams.Values {
+			form[k] = append([]string(nil), v...)
+		}
+		a.FormParams.Values = form
+	}
+
+	rd.names(a.RequestHeaders.Header)
+	rd.names(a.QueryParams.Values)
+	rd.names(a.FormParams.Values)
 
-	if bodyIsJSON && len(a.RequestBody) > 0 {
-		err := json.Unmarshal(a.RequestBody, &body)
+	if len(a.RequestBody) == 0 {
+		return
+	}
+	ct := strings.ToLower(r.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(ct, "application/json"):
+		var body interface{}
+		dec := json.NewDecoder(bytes.NewReader(a.RequestBody))
+		dec.UseNumber()
+		err := dec.Decode(&body)
 		if err != nil {
-			msgFmt := "could not parse body for %s %s"
-			msgArgs := []interface{}{r.Method, r.URL.String()}
+			// Usually because it was cut off by MaxSize. Never log the
+			// unfiltered body or query string.
+			a.RequestBody = rd.jsonTokens(a.RequestBody)
 
+			msgFmt := "could not parse body for %s %s"
+			msgArgs := []interface{}{r.Method, r.URL.Path}
 			if !opts.SkipLogRawBody {
 				msgFmt += ": %s"
 				msgArgs = append(msgArgs, stringutil.Left(string(a.RequestBody), 4000))
 			}
 			opts.Auditor.Log(r, errors.Wrapf(err, msgFmt, msgArgs...))
-		}
-	}
-
-	for _, field := range opts.FilteredFields {
-		if a.RequestHeaders.Get(field) != "" {
-			a.RequestHeaders.Set(field, "[FILTERED]")
-		}
-
-		if a.FormParams.Get(field) != "" {
-			a.FormParams.Set(field, "[FILTERED]")
-		}
-
-		if a.QueryParams.Get(field) != "" {
-			a.QueryParams.Set(field, "[FILTERED]")
+			return
 		}
 
-		if _, ok := body[field]; ok {
-			body[field] = "[FILTERED]"
+		b, err := json.Marshal(rd.json(body, nil))
+		if err != nil {
+			opts.Auditor.Log(r, errors.Wrap(err, "could not marshal body"))
 		}
-	}
+		a.RequestBody = b
 
-	if bodyIsJSON && len(body) > 0 {
-		b, err := json.Marshal(body)
+	case strings.HasPrefix(ct, "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(string(a.RequestBody))
 		if err != nil {
-			opts.Auditor.Log(r, errors.Wrap(err, "could not marshal body"))
+			a.RequestBody = []byte(rd.value(string(a.RequestBody)))
+			return
+		}
+		rd.names(form)
+		a.RequestBody = []byte(form.Encode())
+
+	case strings.HasPrefix(ct, "multipart/form-data"):
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || params["boundary"] == "" {
+			a.RequestBody = []byte(filtered)
+			return
 		}
+		a.RequestBody = rd.multipart(a.RequestBody, params["boundary"])
 
-		a.RequestBody = b
+	default:
+		a.RequestBody = []byte(rd.value(string(a.RequestBody)))
 	}
 }
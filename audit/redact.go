@@ -0,0 +1,466 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Some commonly used patterns for Options.FilteredValues.
+var (
+	// PatternCreditCard matches credit card numbers, optionally with spaces or
+	// dashes between the digits.
+	//
+	// It matches any number of 13 to 19 digits starting with 2-6, so it also
+	// matches other numbers such as IDs; use FilterCreditCards to only filter
+	// numbers with a valid checksum.
+	PatternCreditCard = regexp.MustCompile(`\b[2-6](?:[ -]?\d){12,18}\b`)
+
+	// PatternBearerToken matches bearer tokens, e.g. in the Authorization
+	// header.
+	PatternBearerToken = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/-]+=*`)
+
+	// PatternJWT matches JSON Web Tokens.
+	PatternJWT = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+const filtered = "[FILTERED]"
+
+// FilterCreditCards replaces credit card numbers with "[FILTERED]"; unlike
+// PatternCreditCard it only replaces numbers with a valid Luhn checksum. Use it
+// as Options.FilterValue.
+func FilterCreditCards(s string) string {
+	return PatternCreditCard.ReplaceAllStringFunc(s, func(m string) string {
+		if luhn(m) {
+			return filtered
+		}
+		return m
+	})
+}
+
+// luhn reports if the digits in s have a valid Luhn checksum.
+func luhn(s string) bool {
+	var sum, n int
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+// redactor filters fields and values.
+type redactor struct {
+	globs  []string // Bare names.
+	fields []fieldPattern
+	values []*regexp.Regexp
+	fn     func(string) string
+}
+
+// newRedactor parses the field patterns; see Options.FilteredFields.
+func newRedactor(fields []string, values []*regexp.Regexp) (*redactor, error) {
+	rd := &redactor{values: values}
+	for _, f := range fields {
+		if !strings.HasPrefix(f, "$") {
+			rd.globs = append(rd.globs, globName(f))
+			continue
+		}
+		p, err := parseField(f)
+		if err != nil {
+			return nil, err
+		}
+		rd.fields = append(rd.fields, p)
+	}
+	return rd, nil
+}
+
+// redactors caches the redactors for Middleware, which gets the Options by
+// value. It's reset once it has maxRedactors entries, so Options which are
+// created for every request with new regexps don't leak memory.
+var (
+	redactorsMu sync.Mutex
+	redactors   = make(map[string]*redactor)
+)
+
+const maxRedactors = 64
+
+// cachedRedactor gets a redactor from the cache, or creates a new one. The
+// returned redactor is a copy which can be modified.
+func cachedRedactor(fields []string, values []*regexp.Regexp) (*redactor, error) {
+	var key strings.Builder
+	for _, f := range fields {
+		key.WriteString(strconv.Quote(f))
+	}
+	for _, v := range values {
+		fmt.Fprintf(&key, "%p", v)
+	}
+
+	redactorsMu.Lock()
+	defer redactorsMu.Unlock()
+	rd, ok := redactors[key.String()]
+	if !ok {
+		var err error
+		rd, err = newRedactor(fields, values)
+		if err != nil {
+			return nil, err
+		}
+		if len(redactors) >= maxRedactors {
+			redactors = make(map[string]*redactor)
+		}
+		redactors[key.String()] = rd
+	}
+	cp := *rd
+	return &cp, nil
+}
+
+// globName converts a name to a lower-cased glob where only "*" and "?" are
+// special.
+func globName(name string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(strings.ToLower(name))
+}
+
+// field reports if the field at the path should be filtered.
+func (rd *redactor) field(elems []pathElem) bool {
+	if len(elems) == 0 {
+		return false
+	}
+	if last := elems[len(elems)-1]; last.index == -1 {
+		for _, n := range rd.globs {
+			if ok, _ := path.Match(n, last.key); ok {
+				return true
+			}
+		}
+	}
+	for _, p := range rd.fields {
+		if p.match(elems) {
+			return true
+		}
+	}
+	return false
+}
+
+// value filters all matches of the value patterns.
+func (rd *redactor) value(s string) string {
+	for _, re := range rd.values {
+		s = re.ReplaceAllLiteralString(s, filtered)
+	}
+	if rd.fn != nil {
+		s = rd.fn(s)
+	}
+	return s
+}
+
+// names filters http.Header or url.Values in place.
+func (rd *redactor) names(v map[string][]string) {
+	for k, vals := range v {
+		if rd.field([]pathElem{{key: strings.ToLower(k), index: -1}}) {
+			for i := range vals {
+				vals[i] = filtered
+			}
+			continue
+		}
+		for i := range vals {
+			vals[i] = rd.value(vals[i])
+		}
+	}
+}
+
+// json filters a decoded JSON value in place, and returns it.
+func (rd *redactor) json(v interface{}, elems []pathElem) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, c := range vv {
+			e := append(elems[:len(elems):len(elems)], pathElem{key: strings.ToLower(k), index: -1})
+			if rd.field(e) {
+				vv[k] = filtered
+				continue
+			}
+			vv[k] = rd.json(c, e)
+		}
+	case []interface{}:
+		for i, c := range vv {
+			e := append(elems[:len(elems):len(elems)], pathElem{index: i})
+			if rd.field(e) {
+				vv[i] = filtered
+				continue
+			}
+			vv[i] = rd.json(c, e)
+		}
+	case string:
+		return rd.value(vv)
+	case json.Number:
+		// Numbers may be card numbers too.
+		if f := rd.value(string(vv)); f != string(vv) {
+			return f
+		}
+	}
+	return v
+}
+
+// jsonTokens filters a JSON document which can't be decoded, e.g. because it
+// was cut off by MaxSize, token by token. The output stops at the first error,
+// so values which are cut off are never included.
+func (rd *redactor) jsonTokens(body []byte) []byte {
+	type frame struct {
+		object  bool
+		n       int // Number of values.
+		wantKey bool
+		plen    int // Length of the path to the object or array.
+	}
+	var (
+		dec   = json.NewDecoder(bytes.NewReader(body))
+		out   bytes.Buffer
+		elems []pathElem
+		stack []*frame
+		skip  int // Depth in a filtered object or array.
+	)
+	dec.UseNumber()
+
+	// done is called after a value is written.
+	done := func() {
+		if len(stack) > 0 {
+			f := stack[len(stack)-1]
+			f.n++
+			f.wantKey = f.object
+			elems = elems[:f.plen]
+		}
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		d, isDelim := tok.(json.Delim)
+
+		if skip > 0 {
+			switch d {
+			case '{', '[':
+				skip++
+			case '}', ']':
+				if skip--; skip == 0 {
+					done()
+				}
+			}
+			continue
+		}
+
+		if isDelim && (d == '}' || d == ']') {
+			out.WriteByte(byte(d))
+			stack = stack[:len(stack)-1]
+			done()
+			continue
+		}
+
+		if len(stack) > 0 {
+			f := stack[len(stack)-1]
+			if f.n > 0 && (!f.object || f.wantKey) {
+				out.WriteByte(',')
+			}
+			if f.wantKey {
+				k, _ := tok.(string)
+				b, _ := json.Marshal(k)
+				out.Write(b)
+				out.WriteByte(':')
+				elems = append(elems[:f.plen], pathElem{key: strings.ToLower(k), index: -1})
+				f.wantKey = false
+				continue
+			}
+			if !f.object {
+				elems = append(elems[:f.plen], pathElem{index: f.n})
+			}
+		}
+
+		switch {
+		case rd.field(elems):
+			out.WriteString(`"` + filtered + `"`)
+			if isDelim {
+				skip = 1
+			} else {
+				done()
+			}
+		case isDelim:
+			out.WriteByte(byte(d))
+			stack = append(stack, &frame{object: d == '{', wantKey: d == '{', plen: len(elems)})
+		default:
+			b, _ := json.Marshal(rd.json(tok, elems))
+			out.Write(b)
+			done()
+		}
+	}
+	return out.Bytes()
+}
+
+// multipart filters a multipart/form-data body, replacing the parts by their
+// field name. Parts which are cut off, e.g. by MaxSize, are left out.
+func (rd *redactor) multipart(body []byte, boundary string) []byte {
+	var out bytes.Buffer
+	mw := multipart.NewWriter(&out)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return []byte(filtered)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			_ = mw.Close()
+		}
+		if err != nil {
+			break
+		}
+		b, err := io.ReadAll(p)
+		if err != nil {
+			break
+		}
+
+		v := filtered
+		if !rd.field([]pathElem{{key: strings.ToLower(p.FormName()), index: -1}}) {
+			v = rd.value(string(b))
+		}
+		w, err := mw.CreatePart(p.Header)
+		if err != nil {
+			break
+		}
+		_, _ = io.WriteString(w, v)
+	}
+	return out.Bytes()
+}
+
+// pathElem is an object key (lower-cased) or array index in a JSON document.
+// The index is -1 for object keys.
+type pathElem struct {
+	key   string
+	index int
+}
+
+// pathToken is one step of a fieldPattern.
+type pathToken struct {
+	descend bool   // ".."; matches any number of elements.
+	isIndex bool   // "[n]" or "[*]".
+	index   int    // Array index, or -1 for any index.
+	key     string // Lower-cased glob for object keys; "*" also matches indexes.
+}
+
+func (t pathToken) matches(e pathElem) bool {
+	switch {
+	case t.isIndex:
+		return e.index >= 0 && (t.index == -1 || t.index == e.index)
+	case t.key == "*":
+		return true
+	case e.index >= 0:
+		return false
+	default:
+		ok, _ := path.Match(t.key, e.key)
+		return ok
+	}
+}
+
+// fieldPattern is a parsed JSONPath-like pattern.
+type fieldPattern []pathToken
+
+// parseField parses a JSONPath-like pattern; see Options.FilteredFields.
+func parseField(s string) (fieldPattern, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("middleware/audit: invalid field pattern %q: doesn't start with $", s)
+	}
+
+	var (
+		p    fieldPattern
+		rest = s[1:]
+	)
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			p = append(p, pathToken{descend: true})
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				continue
+			}
+		case rest[0] == '.':
+			rest = rest[1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if len(rest) > 1 && (rest[1] == '\'' || rest[1] == '"') {
+				// Quoted names can contain "]".
+				if q := strings.Index(rest[2:], string(rest[1])+"]"); q != -1 {
+					end = q + 3
+				}
+			}
+			if end == -1 {
+				return nil, fmt.Errorf("middleware/audit: invalid field pattern %q: missing ]", s)
+			}
+			sel := rest[1:end]
+			rest = rest[end+1:]
+
+			switch {
+			case sel == "*":
+				p = append(p, pathToken{isIndex: true, index: -1})
+			case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+				p = append(p, pathToken{key: globName(sel[1 : len(sel)-1])})
+			default:
+				n, err := strconv.Atoi(sel)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("middleware/audit: invalid field pattern %q: invalid index %q", s, sel)
+				}
+				p = append(p, pathToken{isIndex: true, index: n})
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("middleware/audit: invalid field pattern %q", s)
+		}
+
+		end := strings.IndexAny(rest, ".[")
+		if end == -1 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("middleware/audit: invalid field pattern %q: empty name", s)
+		}
+		key := strings.ToLower(rest[:end])
+		if _, err := path.Match(key, ""); err != nil {
+			return nil, fmt.Errorf("middleware/audit: invalid field pattern %q: %w", s, err)
+		}
+		p = append(p, pathToken{key: key})
+		rest = rest[end:]
+	}
+
+	if len(p) == 0 || p[len(p)-1].descend {
+		return nil, fmt.Errorf("middleware/audit: invalid field pattern %q: empty name", s)
+	}
+	return p, nil
+}
+
+// match reports if the pattern matches the full path.
+func (p fieldPattern) match(elems []pathElem) bool {
+	if len(p) == 0 {
+		return len(elems) == 0
+	}
+	if p[0].descend {
+		for i := 0; i <= len(elems); i++ {
+			if p[1:].match(elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 || !p[0].matches(elems[0]) {
+		return false
+	}
+	return p[1:].match(elems[1:])
+}
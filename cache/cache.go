@@ -1,13 +1,15 @@
-// Package cache disables browser caching.
+// Package cache controls browser and proxy caching, and caches responses on the
+// server.
 //
-// See: https://tools.ietf.org/html/rfc7234#section-5.2.1.4
+// See: https://www.rfc-editor.org/rfc/rfc9111
 package cache // import "github.com/teamwork/middleware/cache"
 
 import "net/http"
 
 // NoCache sets the Cache-Control header to "no-cache". This tells browsers to
-// always validate a cache (with e.g. If-Match or If-None-Match). It does NOT
-// tell browsers to never store a cache (use NoStore for that).
+// always validate a cache (with e.g. If-Match or If-None-Match; use ETag to
+// handle these). It does NOT tell browsers to never store a cache (use NoStore
+// for that).
 func NoCache(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
@@ -18,6 +20,9 @@ func NoCache(next http.Handler) http.Handler {
 // NoStore sets the Cache-Control header to "no-store, no-cache" which tells
 // browsers to never store a local copy (the no-cache is there to be sure
 // previously stored copies from before this header are revalidated).
+//
+// This doesn't remove responses the browser already cached; use ClearSiteData
+// for that (e.g. on logout).
 func NoStore(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-store,no-cache")
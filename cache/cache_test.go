@@ -40,3 +40,36 @@ func TestNoStore(t *testing.T) {
 		t.Errorf("header wrong: %#v", h)
 	}
 }
+
+func TestClearSiteData(t *testing.T) {
+	cases := []struct {
+		data      ClearData
+		paths     []string
+		path      string
+		wantClear string
+		wantCC    string
+	}{
+		{ClearCache, nil, "/", `"cache"`, "no-store,no-cache"},
+		{ClearCache | ClearCookies | ClearStorage | ClearExecutionContexts, nil, "/",
+			`"cache", "cookies", "storage", "executionContexts"`, "no-store,no-cache"},
+		{ClearAll, nil, "/", `"*"`, "no-store,no-cache"},
+		{ClearCookies, []string{"/logout", "/switch"}, "/switch", `"cookies"`, "no-store,no-cache"},
+		{ClearCookies, []string{"/logout"}, "/logout/x", "", ""},
+		{0, nil, "/", "", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path+" "+tc.data.String(), func(t *testing.T) {
+			rr := test.HTTP(t, test.NewRequest("GET", tc.path, nil), ClearSiteData(tc.data, tc.paths...)(handle{}))
+			if b := rr.Body.String(); b != "handler" {
+				t.Errorf("body wrong: %#v", b)
+			}
+			if h := rr.Header().Get("Clear-Site-Data"); h != tc.wantClear {
+				t.Errorf("Clear-Site-Data wrong\nout:  %#v\nwant: %#v", h, tc.wantClear)
+			}
+			if h := rr.Header().Get("Cache-Control"); h != tc.wantCC {
+				t.Errorf("Cache-Control wrong: %#v", h)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ClearData is a set of Clear-Site-Data directives.
+//
+// See: https://www.w3.org/TR/clear-site-data/
+type ClearData uint8
+
+// Clear-Site-Data directives.
+const (
+	// ClearCache removes the browser's HTTP cache for the origin.
+	ClearCache ClearData = 1 << iota
+
+	// ClearCookies removes all cookies for the registered domain, including
+	// subdomains. This also removes HTTP authentication credentials.
+	ClearCookies
+
+	// ClearStorage removes localStorage, sessionStorage, IndexedDB, service
+	// workers, and other DOM storage.
+	ClearStorage
+
+	// ClearExecutionContexts reloads all browsing contexts (tabs, frames) for
+	// the origin.
+	ClearExecutionContexts
+
+	// ClearAll removes everything, including any data types added in the
+	// future.
+	ClearAll ClearData = 0xff
+)
+
+// String formats the directives as a Clear-Site-Data header value.
+func (c ClearData) String() string {
+	if c == ClearAll {
+		return `"*"`
+	}
+
+	var d []string
+	for _, v := range []struct {
+		flag ClearData
+		name string
+	}{
+		{ClearCache, `"cache"`},
+		{ClearCookies, `"cookies"`},
+		{ClearStorage, `"storage"`},
+		{ClearExecutionContexts, `"executionContexts"`},
+	} {
+		if c&v.flag != 0 {
+			d = append(d, v.name)
+		}
+	}
+	return strings.Join(d, ", ")
+}
+
+// SetClearSiteData sets the Clear-Site-Data header on the response, for
+// example in a logout handler:
+//
+//	cache.SetClearSiteData(w, cache.ClearCache|cache.ClearStorage)
+//
+// Browsers which don't support Clear-Site-Data will still have previously
+// cached responses, so the Cache-Control header is also set to
+// "no-store,no-cache" (like NoStore) to at least prevent caching this response.
+//
+// Browsers only process the header on secure (HTTPS or localhost) origins.
+func SetClearSiteData(w http.ResponseWriter, data ClearData) {
+	if data == 0 {
+		return
+	}
+	w.Header().Set("Clear-Site-Data", data.String())
+	w.Header().Set("Cache-Control", "no-store,no-cache")
+}
+
+// ClearSiteData sets the Clear-Site-Data header on responses to requests for
+// any of the paths; if no paths are given it's set on all responses. Paths
+// must match exactly. For example:
+//
+//	mux.Handle("/", cache.ClearSiteData(cache.ClearCache|cache.ClearCookies,
+//	    "/logout", "/switch-account")(handler))
+//
+// See SetClearSiteData.
+func ClearSiteData(data ClearData, paths ...string) func(http.Handler) http.Handler {
+	match := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		match[p] = struct{}{}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := match[r.URL.Path]; ok || len(paths) == 0 {
+				SetClearSiteData(w, data)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy is a set of Cache-Control response directives.
+//
+// See: https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2
+type Policy struct {
+	// Public allows shared caches (CDNs, proxies) to store the response, even
+	// if it would normally not be cacheable (e.g. with an Authorization
+	// header).
+	Public bool
+
+	// Private allows only the browser to store the response.
+	Private bool
+
+	// NoCache requires the cache to revalidate before every use.
+	NoCache bool
+
+	// NoStore prevents storing the response at all.
+	NoStore bool
+
+	// MustRevalidate prevents using a stale response without revalidating.
+	MustRevalidate bool
+
+	// Immutable indicates the response will never change while it's fresh,
+	// so browsers don't need to revalidate on reload.
+	Immutable bool
+
+	// MaxAge is how long the response is fresh. Durations of 0 are left out;
+	// set MaxAgeZero to send "max-age=0".
+	MaxAge     time.Duration
+	MaxAgeZero bool
+
+	// SMaxAge overrides MaxAge for shared caches. Set SMaxAgeZero to send
+	// "s-maxage=0".
+	SMaxAge     time.Duration
+	SMaxAgeZero bool
+
+	// StaleWhileRevalidate allows serving a stale response for this long
+	// while revalidating in the background (RFC 5861).
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError allows serving a stale response for this long if
+	// revalidating fails (RFC 5861).
+	StaleIfError time.Duration
+}
+
+// Some commonly used policies.
+var (
+	// PolicyNoStore is the same as the NoStore middleware.
+	PolicyNoStore = Policy{NoStore: true, NoCache: true}
+
+	// PolicyNoCache is the same as the NoCache middleware.
+	PolicyNoCache = Policy{NoCache: true}
+
+	// PolicyImmutable is for fingerprinted assets which never change.
+	PolicyImmutable = Policy{Public: true, MaxAge: 365 * 24 * time.Hour, Immutable: true}
+)
+
+// String formats the policy as a Cache-Control header value.
+func (p Policy) String() string {
+	var d []string
+	switch {
+	case p.Public:
+		d = append(d, "public")
+	case p.Private:
+		d = append(d, "private")
+	}
+	if p.NoStore {
+		d = append(d, "no-store")
+	}
+	if p.NoCache {
+		d = append(d, "no-cache")
+	}
+	if p.MaxAge > 0 || p.MaxAgeZero {
+		d = append(d, "max-age="+seconds(p.MaxAge))
+	}
+	if p.SMaxAge > 0 || p.SMaxAgeZero {
+		d = append(d, "s-maxage="+seconds(p.SMaxAge))
+	}
+	if p.MustRevalidate {
+		d = append(d, "must-revalidate")
+	}
+	if p.Immutable {
+		d = append(d, "immutable")
+	}
+	if p.StaleWhileRevalidate > 0 {
+		d = append(d, "stale-while-revalidate="+seconds(p.StaleWhileRevalidate))
+	}
+	if p.StaleIfError > 0 {
+		d = append(d, "stale-if-error="+seconds(p.StaleIfError))
+	}
+	return strings.Join(d, ",")
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
+
+// Rule applies a Policy to matching responses.
+type Rule struct {
+	// PathPrefix the request path must start with; e.g. "/assets/". Matches
+	// all paths if empty.
+	PathPrefix string
+
+	// ContentTypes the response Content-Type must match; an entry can be a
+	// full media type ("text/html") or a wildcard ("image/*"). Matches all
+	// responses if empty.
+	ContentTypes []string
+
+	Policy Policy
+}
+
+func (rule Rule) match(path, ct string) bool {
+	if !strings.HasPrefix(path, rule.PathPrefix) {
+		return false
+	}
+	if len(rule.ContentTypes) == 0 {
+		return true
+	}
+	for _, want := range rule.ContentTypes {
+		if want == ct || (strings.HasSuffix(want, "/*") &&
+			strings.HasPrefix(ct, strings.TrimSuffix(want, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Control sets the Cache-Control header from the first matching rule.
+//
+// The header is set when the response is written, so rules can match on the
+// Content-Type the handler sets, or when the handler returns if it didn't write
+// anything. Responses which already have a Cache-Control header or don't match
+// any rule are left alone, as are responses matching a rule with an empty
+// Policy.
+//
+// For example:
+//
+//	cache.Control(
+//	    cache.Rule{PathPrefix: "/assets/", Policy: cache.PolicyImmutable},
+//	    cache.Rule{PathPrefix: "/api/", Policy: cache.PolicyNoStore},
+//	    cache.Rule{ContentTypes: []string{"text/html"}, Policy: cache.PolicyNoCache},
+//	    cache.Rule{ContentTypes: []string{"image/*"}, Policy: cache.Policy{
+//	        Public: true, MaxAge: time.Hour, StaleWhileRevalidate: time.Minute,
+//	    }},
+//	)
+func Control(rules ...Rule) func(http.Handler) http.Handler {
+	values := make([]string, len(rules))
+	for i := range rules {
+		values[i] = rules[i].Policy.String()
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hw := &headerWriter{ResponseWriter: w, before: func(h http.Header) {
+				if h.Get("Cache-Control") != "" {
+					return
+				}
+
+				ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+				for i := range rules {
+					if rules[i].match(r.URL.Path, ct) {
+						if values[i] != "" {
+							h.Set("Cache-Control", values[i])
+						}
+						return
+					}
+				}
+			}}
+			next.ServeHTTP(hw, r)
+
+			// net/http sends a 200 for handlers which don't write anything.
+			if !hw.wroteHeader {
+				hw.wroteHeader = true
+				hw.before(hw.Header())
+			}
+		})
+	}
+}
+
+// headerWriter calls before just before the headers are written.
+type headerWriter struct {
+	http.ResponseWriter
+	before      func(http.Header)
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		w.before(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher.
+func (w *headerWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
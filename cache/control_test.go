@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/teamwork/test"
+)
+
+func TestPolicyString(t *testing.T) {
+	cases := []struct {
+		in   Policy
+		want string
+	}{
+		{Policy{}, ""},
+		{PolicyNoStore, "no-store,no-cache"},
+		{PolicyNoCache, "no-cache"},
+		{PolicyImmutable, "public,max-age=31536000,immutable"},
+		{Policy{Private: true, MaxAge: time.Minute, MustRevalidate: true}, "private,max-age=60,must-revalidate"},
+		{Policy{MaxAge: 0, MustRevalidate: true}, "must-revalidate"},
+		{Policy{MaxAgeZero: true, MustRevalidate: true}, "max-age=0,must-revalidate"},
+		{Policy{Public: true, MaxAge: time.Hour, SMaxAgeZero: true}, "public,max-age=3600,s-maxage=0"},
+		{Policy{
+			Public:               true,
+			MaxAge:               time.Minute,
+			SMaxAge:              time.Hour,
+			StaleWhileRevalidate: 30 * time.Second,
+			StaleIfError:         24 * time.Hour,
+		}, "public,max-age=60,s-maxage=3600,stale-while-revalidate=30,stale-if-error=86400"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.want, func(t *testing.T) {
+			if got := tc.in.String(); got != tc.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestControl(t *testing.T) {
+	mw := Control(
+		Rule{PathPrefix: "/assets/none/", Policy: Policy{}},
+		Rule{PathPrefix: "/assets/", Policy: PolicyImmutable},
+		Rule{PathPrefix: "/api/", Policy: PolicyNoStore},
+		Rule{ContentTypes: []string{"text/html"}, Policy: PolicyNoCache},
+		Rule{ContentTypes: []string{"image/*"}, Policy: Policy{Public: true, MaxAge: time.Hour}},
+	)
+
+	cases := []struct {
+		path, ct, cc string
+		want         string
+	}{
+		{"/assets/app.js", "application/javascript", "", "public,max-age=31536000,immutable"},
+		{"/assets/none/app.js", "application/javascript", "", ""},
+		{"/api/users", "application/json", "", "no-store,no-cache"},
+		{"/", "text/html; charset=utf-8", "", "no-cache"},
+		{"/", "", "", "no-cache"}, // Detected from body.
+		{"/logo.png", "image/png", "", "public,max-age=3600"},
+		{"/data.csv", "text/csv", "", ""},
+		{"/api/users", "application/json", "private", "private"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.ct != "" {
+					w.Header().Set("Content-Type", tc.ct)
+				}
+				if tc.cc != "" {
+					w.Header().Set("Cache-Control", tc.cc)
+				}
+				_, _ = w.Write([]byte("<html>handler</html>"))
+			})
+
+			req, err := http.NewRequest("GET", tc.path, nil)
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+			rr := test.HTTP(t, req, mw(h))
+			if h := rr.Header().Get("Cache-Control"); h != tc.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", h, tc.want)
+			}
+			if _, ok := rr.Header()["Cache-Control"]; ok && tc.want == "" {
+				t.Errorf("empty Cache-Control header set")
+			}
+			if b := rr.Body.String(); b != "<html>handler</html>" {
+				t.Errorf("body wrong: %#v", b)
+			}
+		})
+	}
+}
+
+func TestControlNoWrite(t *testing.T) {
+	mw := Control(
+		Rule{PathPrefix: "/api/", Policy: PolicyNoStore},
+		Rule{ContentTypes: []string{"text/html"}, Policy: PolicyNoCache},
+	)
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/api/users", "no-store,no-cache"},
+		{"/", ""}, // No Content-Type to match.
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req, err := http.NewRequest("DELETE", tc.path, nil)
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+			rr := test.HTTP(t, req, mw(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+			if rr.Code != 200 {
+				t.Errorf("want code 200, got %v", rr.Code)
+			}
+			if h := rr.Header().Get("Cache-Control"); h != tc.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", h, tc.want)
+			}
+		})
+	}
+}
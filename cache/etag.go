@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETagOptions for the ETag middleware.
+type ETagOptions struct {
+	// Weak generates weak ETags (W/"..."), which indicate the response is
+	// semantically equivalent rather than byte-for-byte identical. Use this if
+	// the response is modified after this middleware, e.g. by compression.
+	Weak bool
+
+	// MaxSize is the maximum response size to buffer, in bytes; larger
+	// responses are sent without an ETag. Defaults to 1MB.
+	MaxSize int64
+
+	// Current gets the current ETag of the resource for the If-Match check of
+	// unsafe methods; ok is false if the resource doesn't exist.
+	Current func(*http.Request) (etag string, ok bool)
+
+	// GetFallback finds the current ETag for If-Match by making an internal
+	// GET request to the handler if Current is nil. This assumes that GET
+	// requests have no side effects, and runs the full handler for every
+	// conditional request. The precondition fails if the response is larger
+	// than MaxSize and has no ETag header.
+	GetFallback bool
+}
+
+// ETag buffers GET and HEAD responses and sets the ETag header to a hash of the
+// body, if the handler didn't set one. It responds with 304 Not Modified if
+// the request's If-None-Match or If-Modified-Since header matches.
+//
+// For unsafe methods (POST, PUT, PATCH, DELETE) with an If-Match header the
+// current ETag is taken from ETagOptions.Current or ETagOptions.GetFallback,
+// and 412 Precondition Failed is sent if it doesn't match. The If-Match header
+// is left to the handler if neither is set.
+//
+// Only 200 OK responses get an ETag.
+func ETag(opts ETagOptions) func(http.Handler) http.Handler {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 1 << 20
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead:
+			default:
+				if ifMatch := r.Header.Get("If-Match"); ifMatch != "" &&
+					(opts.Current != nil || opts.GetFallback) && !ifMatchOK(next, r, ifMatch, opts) {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &recorder{ResponseWriter: w, max: opts.MaxSize, head: r.Method == http.MethodHead}
+			next.ServeHTTP(rec, r)
+			if rec.streaming {
+				return
+			}
+			if rec.code() != http.StatusOK {
+				rec.flush(w)
+				return
+			}
+
+			// Handlers don't need to send a body for HEAD; we can't make an
+			// ETag if they didn't.
+			if w.Header().Get("ETag") == "" && (r.Method == http.MethodGet || rec.body.Len() > 0) {
+				w.Header().Set("ETag", makeETag(rec.body.Bytes(), opts.Weak))
+			}
+
+			if notModified(r, w.Header()) {
+				writeNotModified(w)
+				return
+			}
+			rec.flush(w)
+		})
+	}
+}
+
+// makeETag creates an ETag from a hash of the body.
+func makeETag(body []byte, weak bool) string {
+	h := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(h[:16]) + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// ifMatchOK checks the If-Match header against the current ETag.
+func ifMatchOK(next http.Handler, r *http.Request, ifMatch string, opts ETagOptions) bool {
+	var (
+		etag string
+		ok   bool
+	)
+	if opts.Current != nil {
+		etag, ok = opts.Current(r)
+	} else {
+		etag, ok = getETag(next, r, opts)
+	}
+
+	// "*" matches any current representation.
+	if !ok {
+		return false
+	}
+	if strings.TrimSpace(ifMatch) == "*" {
+		return true
+	}
+
+	// If-Match uses the strong comparison, so weak ETags never match.
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, m := range splitETags(ifMatch) {
+		if m == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// getETag gets the ETag of a GET request for the same URL; ok is false if the
+// response isn't 2xx, or if it's larger than MaxSize and has no ETag header.
+func getETag(next http.Handler, r *http.Request, opts ETagOptions) (etag string, ok bool) {
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	get.Body = http.NoBody
+	get.ContentLength = 0
+	for _, h := range []string{"If-Match", "If-None-Match", "If-Modified-Since",
+		"If-Unmodified-Since", "If-Range", "Content-Type", "Content-Length"} {
+		get.Header.Del(h)
+	}
+
+	rec := &recorder{max: opts.MaxSize}
+	next.ServeHTTP(rec, get)
+	if rec.code() < 200 || rec.code() > 299 {
+		return "", false
+	}
+	if etag := rec.Header().Get("ETag"); etag != "" {
+		return etag, true
+	}
+	if rec.discarded {
+		return "", false
+	}
+	return makeETag(rec.body.Bytes(), opts.Weak), true
+}
+
+// notModified checks the If-None-Match and If-Modified-Since headers.
+//
+// See: https://www.rfc-editor.org/rfc/rfc9110#section-13.2.2
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, m := range splitETags(inm) {
+			// If-None-Match uses the weak comparison.
+			if m == "*" || strings.TrimPrefix(m, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lm.Truncate(time.Second).After(ims)
+}
+
+func splitETags(s string) []string {
+	var etags []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			etags = append(etags, e)
+		}
+	}
+	return etags
+}
+
+// writeNotModified sends a 304 response, removing the headers which describe
+// the body.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	if h.Get("ETag") != "" {
+		delete(h, "Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
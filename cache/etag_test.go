@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/teamwork/test"
+)
+
+func TestETag(t *testing.T) {
+	etag := makeETag([]byte("handler"), false)
+
+	cases := []struct {
+		name       string
+		method     string
+		header     http.Header
+		handler    http.Handler
+		wantCode   int
+		wantBody   string
+		wantETag   string
+		wantCalled bool
+	}{
+		{"no condition", "GET", nil, handle{}, 200, "handler", etag, true},
+		{"if-none-match", "GET", http.Header{"If-None-Match": {etag}}, handle{}, 304, "", etag, true},
+		{"if-none-match weak", "GET", http.Header{"If-None-Match": {`"x", W/` + etag}}, handle{}, 304, "", etag, true},
+		{"if-none-match star", "GET", http.Header{"If-None-Match": {"*"}}, handle{}, 304, "", etag, true},
+		{"if-none-match mismatch", "GET", http.Header{"If-None-Match": {`"x"`}}, handle{}, 200, "handler", etag, true},
+		{"if-modified-since", "GET", http.Header{"If-Modified-Since": {"Tue, 01 Jan 2019 00:00:00 GMT"}},
+			lastModified("Mon, 31 Dec 2018 00:00:00 GMT"), 304, "", etag, true},
+		{"modified since", "GET", http.Header{"If-Modified-Since": {"Tue, 01 Jan 2019 00:00:00 GMT"}},
+			lastModified("Wed, 02 Jan 2019 00:00:00 GMT"), 200, "handler", etag, true},
+		{"not 200", "GET", http.Header{"If-None-Match": {"*"}}, status(404), 404, "handler", "", true},
+		{"handler etag", "GET", http.Header{"If-None-Match": {`"v1"`}}, withETag(`"v1"`), 304, "", `"v1"`, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			called := false
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == tc.method {
+					called = true
+				}
+				tc.handler.ServeHTTP(w, r)
+			})
+
+			req, err := http.NewRequest(tc.method, "/", strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+
+			rr := test.HTTP(t, req, ETag(ETagOptions{})(h))
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %v, got %v", tc.wantCode, rr.Code)
+			}
+			if b := rr.Body.String(); b != tc.wantBody {
+				t.Errorf("body wrong: %#v", b)
+			}
+			if h := rr.Header().Get("ETag"); h != tc.wantETag {
+				t.Errorf("ETag wrong\nout:  %#v\nwant: %#v", h, tc.wantETag)
+			}
+			if called != tc.wantCalled {
+				t.Errorf("want called %v, got %v", tc.wantCalled, called)
+			}
+		})
+	}
+}
+
+func TestETagIfMatch(t *testing.T) {
+	etag := makeETag([]byte("handler"), false)
+	current := func(etag string, ok bool) func(*http.Request) (string, bool) {
+		return func(*http.Request) (string, bool) { return etag, ok }
+	}
+
+	cases := []struct {
+		name       string
+		opts       ETagOptions
+		ifMatch    string
+		handler    http.Handler
+		wantCode   int
+		wantCalled bool
+	}{
+		{"no current", ETagOptions{}, `"old"`, handle{}, 200, true},
+
+		{"current", ETagOptions{Current: current(`"v1"`, true)}, `"v0", "v1"`, handle{}, 200, true},
+		{"current star", ETagOptions{Current: current(`"v1"`, true)}, "*", handle{}, 200, true},
+		{"current mismatch", ETagOptions{Current: current(`"v1"`, true)}, `"v0"`, handle{}, 412, false},
+		{"current weak", ETagOptions{Current: current(`W/"v1"`, true)}, `W/"v1"`, handle{}, 412, false},
+		{"current missing", ETagOptions{Current: current("", false)}, "*", handle{}, 412, false},
+		{"current first", ETagOptions{Current: current(`"v1"`, true), GetFallback: true}, `"v1"`, handle{}, 200, true},
+
+		{"get", ETagOptions{GetFallback: true}, etag, handle{}, 200, true},
+		{"get star", ETagOptions{GetFallback: true}, "*", handle{}, 200, true},
+		{"get mismatch", ETagOptions{GetFallback: true}, `"old"`, handle{}, 412, false},
+		{"get weak", ETagOptions{GetFallback: true}, "W/" + etag, handle{}, 412, false},
+		{"get not found", ETagOptions{GetFallback: true}, "*", status(404), 412, false},
+		{"get handler etag", ETagOptions{GetFallback: true, MaxSize: 3}, `"v1"`, withETag(`"v1"`), 200, true},
+		{"get too large", ETagOptions{GetFallback: true, MaxSize: 3}, etag, handle{}, 412, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			called := false
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut {
+					called = true
+				}
+				tc.handler.ServeHTTP(w, r)
+			})
+
+			req, err := http.NewRequest(http.MethodPut, "/", strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+			req.Header.Set("If-Match", tc.ifMatch)
+
+			rr := test.HTTP(t, req, ETag(tc.opts)(h))
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %v, got %v", tc.wantCode, rr.Code)
+			}
+			if called != tc.wantCalled {
+				t.Errorf("want called %v, got %v", tc.wantCalled, called)
+			}
+		})
+	}
+}
+
+func TestETagLarge(t *testing.T) {
+	rr := test.HTTP(t, nil, ETag(ETagOptions{MaxSize: 3})(handle{}))
+	if rr.Code != 200 {
+		t.Errorf("want code 200, got %v", rr.Code)
+	}
+	if b := rr.Body.String(); b != "handler" {
+		t.Errorf("body wrong: %#v", b)
+	}
+	if h := rr.Header().Get("ETag"); h != "" {
+		t.Errorf("ETag set: %#v", h)
+	}
+}
+
+func TestETagHead(t *testing.T) {
+	cases := []struct {
+		name       string
+		handler    http.Handler
+		wantLength string
+		wantETag   string
+	}{
+		{"no body", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+		}), "", ""},
+		{"handler length", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "7")
+		}), "7", ""},
+		{"body", handle{}, "7", makeETag([]byte("handler"), false)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodHead, "/", nil)
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+
+			rr := test.HTTP(t, req, ETag(ETagOptions{})(tc.handler))
+			if rr.Code != 200 {
+				t.Errorf("want code 200, got %v", rr.Code)
+			}
+			if h := rr.Header().Get("Content-Length"); h != tc.wantLength {
+				t.Errorf("Content-Length wrong\nout:  %#v\nwant: %#v", h, tc.wantLength)
+			}
+			if h := rr.Header().Get("ETag"); h != tc.wantETag {
+				t.Errorf("ETag wrong\nout:  %#v\nwant: %#v", h, tc.wantETag)
+			}
+		})
+	}
+}
+
+type status int
+
+func (s status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(int(s))
+	_, _ = w.Write([]byte("handler"))
+}
+
+type lastModified string
+
+func (lm lastModified) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Last-Modified", string(lm))
+	_, _ = w.Write([]byte("handler"))
+}
+
+type withETag string
+
+func (e withETag) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", string(e))
+	_, _ = w.Write([]byte("handler"))
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Purger is implemented by stores which can remove entries by tag or key
+// prefix.
+type Purger interface {
+	// PurgeTags removes all entries with any of the tags.
+	PurgeTags(ctx context.Context, tags ...string) (int, error)
+
+	// PurgePrefix removes all entries with a key starting with prefix.
+	PurgePrefix(ctx context.Context, prefix string) (int, error)
+}
+
+type tagKey struct{}
+
+// tagSet collects the tags added with Tag.
+type tagSet struct {
+	mu   sync.Mutex
+	tags []string
+}
+
+// Tag adds surrogate keys to the response for r, which can be used to purge it
+// from the cache with Invalidator.Tags. For example:
+//
+//	cache.Tag(r, "project:123", "user:42")
+//
+// Handlers can also set the Surrogate-Key header directly. Tag does nothing if
+// the request isn't handled by the Server middleware.
+func Tag(r *http.Request, tags ...string) {
+	ts, ok := r.Context().Value(tagKey{}).(*tagSet)
+	if !ok {
+		return
+	}
+	ts.mu.Lock()
+	ts.tags = append(ts.tags, tags...)
+	ts.mu.Unlock()
+}
+
+// apply merges the tags in to the Surrogate-Key header.
+func (ts *tagSet) apply(h http.Header) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tags := append(strings.Fields(h.Get("Surrogate-Key")), ts.tags...)
+	if len(tags) == 0 {
+		return
+	}
+	sort.Strings(tags)
+	uniq := tags[:1]
+	for _, t := range tags[1:] {
+		if t != uniq[len(uniq)-1] {
+			uniq = append(uniq, t)
+		}
+	}
+	h.Set("Surrogate-Key", strings.Join(uniq, " "))
+}
+
+// serveTagged runs the handler with a tag collector in the request context, and
+// sets the Surrogate-Key header before the response is sent.
+func serveTagged(next http.Handler, rec *recorder, r *http.Request) {
+	ts := &tagSet{}
+	onStream := rec.onStream
+	rec.onStream = func() {
+		ts.apply(rec.Header())
+		if onStream != nil {
+			onStream()
+		}
+	}
+	next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), tagKey{}, ts)))
+	if !rec.streaming {
+		ts.apply(rec.Header())
+	}
+}
+
+// Invalidator purges responses cached by the Server middleware.
+//
+// The URL and Prefix methods assume the default ServerOptions.Key.
+type Invalidator struct {
+	store Store
+}
+
+// NewInvalidator creates a new Invalidator for store, which must implement
+// Purger.
+func NewInvalidator(store Store) *Invalidator {
+	if _, ok := store.(Purger); !ok {
+		panic("middleware/cache: store does not implement Purger")
+	}
+	return &Invalidator{store: store}
+}
+
+// Tags purges all responses with any of the tags.
+func (inv *Invalidator) Tags(ctx context.Context, tags ...string) (int, error) {
+	return inv.store.(Purger).PurgeTags(ctx, tags...)
+}
+
+// URL purges the response for the absolute URL, e.g.
+// "https://example.com/projects/1?x=y", including all variants from the Vary
+// header.
+func (inv *Invalidator) URL(ctx context.Context, rawURL string) (int, error) {
+	key, err := urlKey(rawURL)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := inv.store.(Purger).PurgePrefix(ctx, key+"\x00")
+	if err != nil {
+		return n, err
+	}
+	e, err := inv.store.Get(ctx, key)
+	if err != nil || e == nil {
+		return n, err
+	}
+	return n + 1, inv.store.Delete(ctx, key)
+}
+
+// Prefix purges all responses for URLs starting with rawURL, e.g.
+// "https://example.com/projects/".
+func (inv *Invalidator) Prefix(ctx context.Context, rawURL string) (int, error) {
+	key, err := urlKey(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	return inv.store.(Purger).PurgePrefix(ctx, key)
+}
+
+// ServeHTTP is an admin endpoint to purge responses; it accepts POST or PURGE
+// requests with one or more tag, url, or prefix parameters. For example:
+//
+//	curl -X POST https://example.com/admin/cache/purge -d tag=project:123 -d tag=user:42
+//
+// It responds with the number of purged responses as JSON: {"purged": 2}.
+//
+// There is no authentication; wrap it in e.g. auth.Auth.
+func (inv *Invalidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != "PURGE" {
+		w.Header().Set("Allow", "POST, PURGE")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		ctx    = r.Context()
+		total  int
+		tags   = r.Form["tag"]
+		urls   = r.Form["url"]
+		prefix = r.Form["prefix"]
+	)
+	if len(tags)+len(urls)+len(prefix) == 0 {
+		http.Error(w, "Need at least one tag, url, or prefix parameter.", http.StatusBadRequest)
+		return
+	}
+
+	fail := func(err error) {
+		http.Error(w, "Purge failed: "+err.Error(), http.StatusInternalServerError)
+	}
+	if len(tags) > 0 {
+		n, err := inv.Tags(ctx, tags...)
+		if err != nil {
+			fail(err)
+			return
+		}
+		total += n
+	}
+	for _, u := range urls {
+		n, err := inv.URL(ctx, u)
+		if err != nil {
+			fail(err)
+			return
+		}
+		total += n
+	}
+	for _, p := range prefix {
+		n, err := inv.Prefix(ctx, p)
+		if err != nil {
+			fail(err)
+			return
+		}
+		total += n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"purged": total})
+}
+
+// urlKey gets the default cache key for an absolute URL.
+func urlKey(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid URL %q", rawURL)
+	}
+	if u.Host == "" {
+		return "", errors.Errorf("URL %q has no host", rawURL)
+	}
+	return u.Host + u.RequestURI(), nil
+}
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+)
+
+// tagged responds with the call count and tags it with the tag query parameter.
+type tagged struct{ calls int32 }
+
+func (h *tagged) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&h.calls, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Surrogate-Key", "all b-header")
+	Tag(r, strings.Split(r.URL.Query().Get("tag"), ",")...)
+	_, _ = fmt.Fprintf(w, "call %d", n)
+}
+
+func TestTag(t *testing.T) {
+	h := Server(ServerOptions{Store: NewMemoryStore(1 << 20)})(&tagged{})
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/?tag=z,a,all", nil))
+		if k := rr.Header().Get("Surrogate-Key"); k != "a all b-header z" {
+			t.Errorf("wrong Surrogate-Key: %#v", k)
+		}
+	}
+
+	// No-op without the middleware.
+	Tag(httptest.NewRequest("GET", "/", nil), "x")
+}
+
+func TestInvalidator(t *testing.T) {
+	store := NewMemoryStore(1 << 20)
+	inv := NewInvalidator(store)
+	h := Server(ServerOptions{Store: store})(&tagged{})
+
+	get := func(u string) string {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", u, nil))
+		return rr.Body.String()
+	}
+	purge := func(form url.Values) string {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/purge", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		inv.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	get("http://example.com/p/1?tag=p1")
+	get("http://example.com/p/2?tag=p2")
+	get("http://example.com/p/12?tag=p12")
+	get("http://example.com/x?tag=p1")
+	if store.Len() != 4 {
+		t.Fatalf("want 4 entries, got %d", store.Len())
+	}
+
+	if out := purge(url.Values{"tag": {"p1"}}); out != `{"purged":2}` {
+		t.Errorf("wrong output: %s", out)
+	}
+	if store.Len() != 2 {
+		t.Errorf("want 2 entries, got %d", store.Len())
+	}
+	if b := get("http://example.com/p/2?tag=p2"); b != "call 2" {
+		t.Errorf("p/2 purged: %s", b)
+	}
+
+	// Doesn't purge /p/12.
+	if out := purge(url.Values{"url": {"http://example.com/p/1?tag=p1"}}); out != `{"purged":0}` {
+		t.Errorf("wrong output: %s", out)
+	}
+	if out := purge(url.Values{"url": {"http://example.com/p/2?tag=p2"}}); out != `{"purged":1}` {
+		t.Errorf("wrong output: %s", out)
+	}
+	if out := purge(url.Values{"prefix": {"http://example.com/p/"}}); out != `{"purged":1}` {
+		t.Errorf("wrong output: %s", out)
+	}
+	if store.Len() != 0 {
+		t.Errorf("want 0 entries, got %d", store.Len())
+	}
+	if len(store.tags) != 0 {
+		t.Errorf("tags not removed: %v", store.tags)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if out := purge(url.Values{}); !strings.HasPrefix(out, "Need at least") {
+			t.Errorf("wrong output: %s", out)
+		}
+		if out := purge(url.Values{"url": {"/relative"}}); !strings.Contains(out, "has no host") {
+			t.Errorf("wrong output: %s", out)
+		}
+
+		rr := httptest.NewRecorder()
+		inv.ServeHTTP(rr, httptest.NewRequest("GET", "/purge?tag=x", nil))
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("wrong code: %d", rr.Code)
+		}
+	})
+}
+
+func TestInvalidatorVary(t *testing.T) {
+	store := NewMemoryStore(1 << 20)
+	c := &counter{header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}}
+	h := Server(ServerOptions{Store: store})(c)
+
+	for _, lang := range []string{"en", "nl"} {
+		req := httptest.NewRequest("GET", "http://example.com/path", nil)
+		req.Header.Set("Accept-Language", lang)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	n, err := NewInvalidator(store).URL(context.Background(), "http://example.com/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || store.Len() != 0 {
+		t.Errorf("want 3 purged and 0 left, got %d and %d", n, store.Len())
+	}
+}
+
+func TestRedisStorePurge(t *testing.T) {
+	ctx := context.Background()
+	conn := redigomock.NewConn()
+	s := NewRedisStore(mockPool{conn}, "rc:")
+
+	conn.GenericCommand("SET").Expect("OK")
+	sadd := conn.Command("SADD", "rc:tag:t", "rc:key").Expect(int64(1))
+	expire := conn.Command("PEXPIRE", "rc:tag:t", tagTTL).Expect(int64(1))
+	if err := s.Set(ctx, "key", &Entry{Tags: []string{"t"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Stats(sadd) != 1 || conn.Stats(expire) != 1 {
+		t.Error("tag not stored")
+	}
+
+	conn.Command("SMEMBERS", "rc:tag:t").Expect([]interface{}{[]byte("rc:key"), []byte("rc:gone")})
+	conn.Command("DEL", "rc:key", "rc:gone").Expect(int64(1))
+	conn.Command("DEL", "rc:tag:t").Expect(int64(1))
+	n, err := s.PurgeTags(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 purged, got %d", n)
+	}
+
+	conn.Command("SCAN", "0", "MATCH", `rc:a\*b*`, "COUNT", 1000).
+		Expect([]interface{}{[]byte("5"), []interface{}{[]byte("rc:a*b1")}})
+	conn.Command("SCAN", "5", "MATCH", `rc:a\*b*`, "COUNT", 1000).
+		Expect([]interface{}{[]byte("0"), []interface{}{[]byte("rc:a*b2")}})
+	conn.Command("DEL", "rc:a*b1").Expect(int64(1))
+	conn.Command("DEL", "rc:a*b2").Expect(int64(1))
+	n, err = s.PurgePrefix(ctx, "a*b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 purged, got %d", n)
+	}
+
+	conn.Command("SMEMBERS", "rc:tag:err").ExpectError(redis.ErrPoolExhausted)
+	if _, err := s.PurgeTags(ctx, "err"); err == nil {
+		t.Error("no error")
+	}
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Result is how the Server middleware served a request; it's sent in the
+// X-Cache header.
+type Result string
+
+// Possible results.
+const (
+	// ResultHit is a fresh response from the cache.
+	ResultHit Result = "HIT"
+
+	// ResultMiss is a response from the handler.
+	ResultMiss Result = "MISS"
+
+	// ResultStale is an expired response from the cache, served while
+	// revalidating or because the handler failed.
+	ResultStale Result = "STALE"
+)
+
+// Observer is notified of cache events, e.g. to record metrics.
+//
+// Evict and Size are only called by stores which can report them, such as
+// MemoryStore; the store reports to the observer of every Server it's used
+// with.
+//
+// All methods may be called concurrently.
+type Observer interface {
+	// Request is called for every GET or HEAD request after it's served.
+	Request(r *http.Request, res Result)
+
+	// Fill is called after the handler ran to fill the cache, with how long
+	// it took and if the response was stored.
+	Fill(r *http.Request, d time.Duration, stored bool)
+
+	// Evict is called when a store removes an entry to make room for new
+	// ones.
+	Evict(key string)
+
+	// Size is called when the store changes, with the number of entries and
+	// their total size in bytes.
+	Size(entries int, bytes int64)
+}
+
+// observable is implemented by stores which report to an Observer.
+type observable interface {
+	observe(Observer)
+}
+
+// Metrics is an Observer which counts cache events.
+type Metrics struct {
+	hits, misses, stale  int64
+	fills, stored, evict int64
+	fillTime             int64
+	entries, bytes       int64
+}
+
+// MetricsStats are the counters from Metrics.
+type MetricsStats struct {
+	Hits, Misses, Stale int64
+
+	// Fills is the number of handler calls to fill the cache, of which Stored
+	// were stored; FillTime is the total time spent on them.
+	Fills, Stored int64
+	FillTime      time.Duration
+
+	Evictions int64
+
+	// Entries and Bytes are the store's current size.
+	Entries int64
+	Bytes   int64
+}
+
+// HitRatio gets the fraction of requests served from the cache, including
+// stale responses.
+func (s MetricsStats) HitRatio() float64 {
+	total := s.Hits + s.Misses + s.Stale
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.Stale) / float64(total)
+}
+
+// AvgFillTime gets the average time it took to fill the cache.
+func (s MetricsStats) AvgFillTime() time.Duration {
+	if s.Fills == 0 {
+		return 0
+	}
+	return s.FillTime / time.Duration(s.Fills)
+}
+
+// Stats gets the current counters.
+func (m *Metrics) Stats() MetricsStats {
+	return MetricsStats{
+		Hits:      atomic.LoadInt64(&m.hits),
+		Misses:    atomic.LoadInt64(&m.misses),
+		Stale:     atomic.LoadInt64(&m.stale),
+		Fills:     atomic.LoadInt64(&m.fills),
+		Stored:    atomic.LoadInt64(&m.stored),
+		FillTime:  time.Duration(atomic.LoadInt64(&m.fillTime)),
+		Evictions: atomic.LoadInt64(&m.evict),
+		Entries:   atomic.LoadInt64(&m.entries),
+		Bytes:     atomic.LoadInt64(&m.bytes),
+	}
+}
+
+// Request implements Observer.
+func (m *Metrics) Request(_ *http.Request, res Result) {
+	switch res {
+	case ResultHit:
+		atomic.AddInt64(&m.hits, 1)
+	case ResultStale:
+		atomic.AddInt64(&m.stale, 1)
+	default:
+		atomic.AddInt64(&m.misses, 1)
+	}
+}
+
+// Fill implements Observer.
+func (m *Metrics) Fill(_ *http.Request, d time.Duration, stored bool) {
+	atomic.AddInt64(&m.fills, 1)
+	atomic.AddInt64(&m.fillTime, int64(d))
+	if stored {
+		atomic.AddInt64(&m.stored, 1)
+	}
+}
+
+// Evict implements Observer.
+func (m *Metrics) Evict(string) { atomic.AddInt64(&m.evict, 1) }
+
+// Size implements Observer.
+func (m *Metrics) Size(entries int, bytes int64) {
+	atomic.StoreInt64(&m.entries, int64(entries))
+	atomic.StoreInt64(&m.bytes, bytes)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) Request(*http.Request, Result)           {}
+func (nopObserver) Fill(*http.Request, time.Duration, bool) {}
+func (nopObserver) Evict(string)                            {}
+func (nopObserver) Size(int, int64)                         {}
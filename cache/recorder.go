@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// recorder buffers a response so it can be inspected before it's sent.
+//
+// If ResponseWriter is set the handler's headers are written to it directly,
+// and the recorder switches to writing directly to it (streaming) once the
+// body grows larger than max bytes or the handler calls Flush().
+//
+// If it's nil the recorder is detached: attach is called instead, and the
+// response is streamed to the ResponseWriter it returns. If attach is nil or
+// returns nil the rest of the body is discarded.
+type recorder struct {
+	http.ResponseWriter
+	max    int64
+	attach func() http.ResponseWriter
+
+	// head is set for HEAD requests, where the handler doesn't need to write
+	// the body.
+	head bool
+
+	// onStream is called before switching to streaming.
+	onStream func()
+
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+	streaming   bool
+	discarded   bool
+}
+
+func (rec *recorder) Header() http.Header {
+	if rec.ResponseWriter != nil {
+		return rec.ResponseWriter.Header()
+	}
+	if rec.header == nil {
+		rec.header = make(http.Header)
+	}
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	if code < 200 {
+		if rec.ResponseWriter != nil {
+			rec.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	rec.status = code
+	rec.wroteHeader = true
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.streaming {
+		return rec.ResponseWriter.Write(b)
+	}
+	if rec.discarded {
+		return len(b), nil
+	}
+	if int64(rec.body.Len()+len(b)) > rec.max {
+		if err := rec.overflow(); err != nil {
+			return 0, err
+		}
+		if rec.discarded {
+			return len(b), nil
+		}
+		return rec.ResponseWriter.Write(b)
+	}
+	return rec.body.Write(b)
+}
+
+// Flush implements http.Flusher; it switches to streaming.
+func (rec *recorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.streaming && !rec.discarded {
+		_ = rec.overflow()
+	}
+	if !rec.streaming {
+		return
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// overflow switches to streaming, attaching a detached recorder first. If
+// that's not possible the body is discarded.
+func (rec *recorder) overflow() error {
+	if rec.ResponseWriter == nil {
+		var w http.ResponseWriter
+		if rec.attach != nil {
+			w = rec.attach()
+		}
+		if w == nil {
+			rec.discarded = true
+			rec.body = bytes.Buffer{}
+			return nil
+		}
+		copyHeader(w.Header(), rec.header)
+		rec.ResponseWriter = w
+	}
+	return rec.stream()
+}
+
+// stream writes everything buffered so far and switches to streaming.
+func (rec *recorder) stream() error {
+	rec.streaming = true
+	if rec.onStream != nil {
+		rec.onStream()
+	}
+	rec.ResponseWriter.WriteHeader(rec.status)
+	_, err := rec.ResponseWriter.Write(rec.body.Bytes())
+	rec.body.Reset()
+	return err
+}
+
+// status of the response; 200 if the handler never called WriteHeader.
+func (rec *recorder) code() int {
+	if !rec.wroteHeader {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// flush writes the buffered response to w, setting the Content-Length unless
+// it's an empty response to a HEAD request.
+func (rec *recorder) flush(w http.ResponseWriter) {
+	if rec.streaming || rec.discarded {
+		return
+	}
+	if rec.ResponseWriter == nil {
+		copyHeader(w.Header(), rec.header)
+	}
+	if w.Header().Get("Content-Length") == "" && bodyAllowed(rec.code()) &&
+		!(rec.head && rec.body.Len() == 0) {
+		w.Header().Set("Content-Length", strconv.Itoa(rec.body.Len()))
+	}
+	w.WriteHeader(rec.code())
+	_, _ = w.Write(rec.body.Bytes())
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+// bodyAllowed reports if a response with this status code can have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
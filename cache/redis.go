@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+type redisPool interface {
+	Get() redis.Conn
+}
+
+type redisPoolCtx interface {
+	GetWithContext(ctx context.Context) redis.Conn
+}
+
+// RedisStore stores responses in Redis.
+type RedisStore struct {
+	pool   redisPool
+	prefix string
+}
+
+// NewRedisStore creates a new Redis store; all keys are prefixed with prefix.
+//
+// The pool is usually a *redis.Pool; if it has a GetWithContext() method that
+// will be used to get connections.
+func NewRedisStore(pool redisPool, prefix string) *RedisStore {
+	return &RedisStore{pool: pool, prefix: prefix}
+}
+
+func (s *RedisStore) conn(ctx context.Context) redis.Conn {
+	if poolCtx, ok := s.pool.(redisPoolCtx); ok {
+		return poolCtx.GetWithContext(ctx)
+	}
+	return s.pool.Get()
+}
+
+// Get an entry.
+func (s *RedisStore) Get(ctx context.Context, key string) (*Entry, error) {
+	conn := s.conn(ctx)
+	defer conn.Close() // nolint: errcheck
+
+	b, err := redis.Bytes(conn.Do("GET", s.prefix+key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get %q", key)
+	}
+
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, errors.Wrapf(err, "could not decode %q", key)
+	}
+	return &e, nil
+}
+
+// Set an entry.
+func (s *RedisStore) Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrapf(err, "could not encode %q", key)
+	}
+
+	conn := s.conn(ctx)
+	defer conn.Close() // nolint: errcheck
+
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	if _, err := conn.Do("SET", s.prefix+key, b, "PX", ms); err != nil {
+		return errors.Wrapf(err, "could not set %q", key)
+	}
+
+	// The tag sets may contain keys which no longer exist; that's fine, as
+	// deleting them is a no-op. Expire them eventually so they don't grow
+	// forever.
+	if ms < tagTTL {
+		ms = tagTTL
+	}
+	for _, t := range e.Tags {
+		if _, err := conn.Do("SADD", s.tagKey(t), s.prefix+key); err != nil {
+			return errors.Wrapf(err, "could not tag %q", key)
+		}
+		if _, err := conn.Do("PEXPIRE", s.tagKey(t), ms); err != nil {
+			return errors.Wrapf(err, "could not tag %q", key)
+		}
+	}
+	return nil
+}
+
+// tagTTL is the minimum lifetime of tag sets, in milliseconds.
+const tagTTL = int64(24 * time.Hour / time.Millisecond)
+
+func (s *RedisStore) tagKey(tag string) string {
+	return s.prefix + "tag:" + tag
+}
+
+// Delete an entry.
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	conn := s.conn(ctx)
+	defer conn.Close() // nolint: errcheck
+
+	if _, err := conn.Do("DEL", s.prefix+key); err != nil {
+		return errors.Wrapf(err, "could not delete %q", key)
+	}
+	return nil
+}
+
+// PurgeTags removes all entries with any of the tags.
+func (s *RedisStore) PurgeTags(ctx context.Context, tags ...string) (int, error) {
+	conn := s.conn(ctx)
+	defer conn.Close() // nolint: errcheck
+
+	n := 0
+	for _, t := range tags {
+		keys, err := redis.Strings(conn.Do("SMEMBERS", s.tagKey(t)))
+		if err != nil {
+			return n, errors.Wrapf(err, "could not get tag %q", t)
+		}
+		if len(keys) > 0 {
+			d, err := redis.Int(conn.Do("DEL", redis.Args{}.AddFlat(keys)...))
+			if err != nil {
+				return n, errors.Wrapf(err, "could not purge tag %q", t)
+			}
+			n += d
+		}
+		if _, err := conn.Do("DEL", s.tagKey(t)); err != nil {
+			return n, errors.Wrapf(err, "could not delete tag %q", t)
+		}
+	}
+	return n, nil
+}
+
+// PurgePrefix removes all entries with a key starting with prefix.
+//
+// This uses SCAN, which may be slow on large databases.
+func (s *RedisStore) PurgePrefix(ctx context.Context, prefix string) (int, error) {
+	conn := s.conn(ctx)
+	defer conn.Close() // nolint: errcheck
+
+	var (
+		n      int
+		cursor = "0"
+		match  = globEscape(s.prefix+prefix) + "*"
+	)
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", 1000))
+		if err != nil {
+			return n, errors.Wrapf(err, "could not scan %q", prefix)
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return n, errors.Wrapf(err, "could not scan %q", prefix)
+		}
+		if len(keys) > 0 {
+			d, err := redis.Int(conn.Do("DEL", redis.Args{}.AddFlat(keys)...))
+			if err != nil {
+				return n, errors.Wrapf(err, "could not purge %q", prefix)
+			}
+			n += d
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// globEscape escapes the special characters for the Redis MATCH pattern.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
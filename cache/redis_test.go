@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+)
+
+type mockPool struct{ conn *redigomock.Conn }
+
+func (p mockPool) Get() redis.Conn { return p.conn }
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	conn := redigomock.NewConn()
+	s := NewRedisStore(mockPool{conn}, "rc:")
+
+	e := &Entry{Status: 200, Body: []byte("hello"), Header: map[string][]string{"A": {"b"}}}
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := conn.Command("SET", "rc:key", b, "PX", int64(60000)).Expect("OK")
+	if err := s.Set(ctx, "key", e, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Stats(set) != 1 {
+		t.Error("SET not called")
+	}
+
+	conn.Command("GET", "rc:key").Expect(b)
+	got, err := s.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Body, e.Body) || got.Header.Get("A") != "b" || got.Status != 200 {
+		t.Errorf("wrong entry: %#v", got)
+	}
+
+	conn.Command("GET", "rc:missing").ExpectError(redis.ErrNil)
+	got, err = s.Get(ctx, "missing")
+	if err != nil || got != nil {
+		t.Errorf("want nil, nil; got %#v, %v", got, err)
+	}
+
+	del := conn.Command("DEL", "rc:key").Expect(int64(1))
+	if err := s.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Stats(del) != 1 {
+		t.Error("DEL not called")
+	}
+}
@@ -0,0 +1,644 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teamwork/utils/v2/sliceutil"
+)
+
+// Helper function to make it easier to test.
+var now = func() time.Time { return time.Now() }
+
+// ServerOptions for the Server middleware.
+type ServerOptions struct {
+	// Store for responses; this is required.
+	Store Store
+
+	// DefaultTTL is how long to cache responses which don't have a max-age,
+	// s-maxage, or Expires header. These responses aren't cached if 0.
+	DefaultTTL time.Duration
+
+	// MaxSize is the maximum response body size to cache, in bytes; defaults
+	// to 1MB.
+	MaxSize int64
+
+	// Key generates the cache key for a request; defaults to the host and
+	// request URI.
+	Key func(*http.Request) string
+
+	// StaleWhileRevalidate is how long a response can be served after it
+	// expires while it's refreshed in the background. StaleIfError is how long
+	// it can be served after it expires if the handler returns a 5xx error or
+	// takes longer than Timeout.
+	//
+	// The stale-while-revalidate and stale-if-error Cache-Control directives
+	// take precedence over these, and must-revalidate disables both.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	// Timeout is how long to wait for the handler before serving a stale
+	// response allowed by StaleIfError. Disabled if 0.
+	Timeout time.Duration
+
+	// Log errors from the store; defaults to printing to stderr.
+	Log func(*http.Request, error)
+
+	// Observer is notified of cache events; see Metrics for a simple
+	// implementation.
+	Observer Observer
+
+	// Debug adds an X-Cache-Debug header to responses which weren't cached,
+	// explaining why.
+	Debug bool
+}
+
+// Server caches responses on the server.
+//
+// Only GET requests are cached, and HEAD requests are served from the cached
+// GET response. Responses are cached according to the Cache-Control header the
+// handler sets; s-maxage takes precedence over max-age, and responses with
+// no-store, no-cache, private, or a Set-Cookie header are never cached.
+// Requests with an Authorization header are only cached if the response is
+// marked as public or has an s-maxage.
+//
+// The Vary header is supported: a separate response is cached for every
+// combination of request header values.
+//
+// Concurrent requests for the same uncached key are coalesced: only one request
+// runs the handler, and the others wait for its response.
+//
+// Responses can be tagged with Tag() or the Surrogate-Key header, and purged
+// by tag, URL, or prefix with an Invalidator.
+//
+// The X-Cache header is set to HIT, MISS, or STALE, and the Age header is set
+// on responses from the cache.
+func Server(opts ServerOptions) func(http.Handler) http.Handler {
+	if opts.Store == nil {
+		panic("middleware/cache: Store is nil")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 1 << 20
+	}
+	if opts.Key == nil {
+		opts.Key = func(r *http.Request) string {
+			return r.Host + r.URL.RequestURI()
+		}
+	}
+	if opts.Log == nil {
+		opts.Log = func(r *http.Request, err error) {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: %v\n", r.URL.Path, err)
+		}
+	}
+
+	if opts.Observer == nil {
+		opts.Observer = nopObserver{}
+	} else if o, ok := opts.Store.(observable); ok {
+		o.observe(opts.Observer)
+	}
+
+	s := &server{opts: opts, flights: make(map[string]*flight)}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serve(next, w, r)
+		})
+	}
+}
+
+type server struct {
+	opts ServerOptions
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a handler call for a key; other requests for the same key wait for
+// it to finish.
+type flight struct {
+	done  chan struct{}
+	entry *Entry // nil if the response wasn't cacheable.
+}
+
+func (s *server) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	res := ResultMiss
+	w.Header().Set("X-Cache", string(res))
+	defer func() { s.opts.Observer.Request(r, res) }()
+
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok {
+		s.debug(w, "request has Cache-Control: no-store")
+		next.ServeHTTP(w, r)
+		return
+	}
+	_, noCache := reqCC["no-cache"]
+	if reqCC["max-age"] == "0" {
+		noCache = true
+	}
+
+	var (
+		key   = s.opts.Key(r)
+		stale *Entry
+	)
+	if !noCache {
+		if e := s.lookup(r, key); e != nil {
+			n := now()
+			switch {
+			case n.Before(e.Expires):
+				res = ResultHit
+				writeEntry(w, r, e, res)
+				return
+			case n.Before(e.StaleWhileRevalidate):
+				res = ResultStale
+				writeEntry(w, r, e, res)
+				s.refresh(next, r, key)
+				return
+			case n.Before(e.StaleIfError):
+				stale = e
+			}
+		}
+	}
+
+	// Only GET responses are cached.
+	if r.Method == http.MethodHead {
+		s.debug(w, "HEAD requests are only served from the cache")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// Wait for another request for the same key, if there is one.
+	f, leader := s.join(key, noCache)
+	if !leader {
+		select {
+		case <-f.done:
+			if f.entry != nil && f.entry.Vary == nil {
+				res = ResultHit
+				writeEntry(w, r, f.entry, res)
+				return
+			}
+			s.debug(w, "concurrent request for the same key was not cached")
+		case <-r.Context().Done():
+		}
+		next.ServeHTTP(w, r)
+		return
+	}
+	defer s.finish(key, f)
+
+	if stale != nil {
+		f.entry, res = s.fillOrStale(next, w, r, key, stale)
+		return
+	}
+	f.entry = s.fill(next, w, r, key)
+}
+
+// join the flight for key, or start a new one if there is none (or if force
+// is set). It returns true if this request is the leader.
+func (s *server) join(key string, force bool) (*flight, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.flights[key]; ok && !force {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	s.flights[key] = f
+	return f, true
+}
+
+// finish the flight for key, waking up everyone waiting for it.
+func (s *server) finish(key string, f *flight) {
+	s.mu.Lock()
+	if s.flights[key] == f {
+		delete(s.flights, key)
+	}
+	s.mu.Unlock()
+	close(f.done)
+}
+
+// lookup gets the cached response for the request, which may be stale.
+func (s *server) lookup(r *http.Request, key string) *Entry {
+	e, err := s.opts.Store.Get(r.Context(), key)
+	if err != nil {
+		s.opts.Log(r, err)
+		return nil
+	}
+	if e != nil && e.Vary != nil {
+		e, err = s.opts.Store.Get(r.Context(), variantKey(key, e.Vary, r))
+		if err != nil {
+			s.opts.Log(r, err)
+			return nil
+		}
+	}
+	return e
+}
+
+// fill runs the handler and stores the response if it's cacheable. It returns
+// the entry, or nil if the response wasn't stored.
+func (s *server) fill(next http.Handler, w http.ResponseWriter, r *http.Request, key string) *Entry {
+	var (
+		start  = time.Now()
+		before = w.Header().Clone()
+		rec    = &recorder{ResponseWriter: w, max: s.opts.MaxSize}
+	)
+	rec.onStream = func() { s.debug(w, "response is streamed or larger than MaxSize") }
+	serveTagged(next, rec, r)
+	if rec.streaming {
+		s.opts.Observer.Fill(r, time.Since(start), false)
+		return nil
+	}
+
+	header := headerDiff(before, w.Header())
+	e, reason := s.save(r, key, rec, header)
+	s.opts.Observer.Fill(r, time.Since(start), e != nil)
+	s.debug(w, reason)
+	rec.flush(w)
+	return e
+}
+
+// fillOrStale runs the handler, but sends the stale response instead if the
+// handler fails with a 5xx error or takes longer than the timeout. The handler
+// keeps running in the background after a timeout, and its response is stored
+// if it's cacheable.
+func (s *server) fillOrStale(next http.Handler, w http.ResponseWriter, r *http.Request, key string, stale *Entry) (*Entry, Result) {
+	type result struct {
+		rec    *recorder
+		entry  *Entry
+		reason string
+	}
+
+	var (
+		done      = make(chan result, 1)
+		want      = make(chan struct{})
+		abandoned = make(chan struct{})
+		req       = r.Clone(detach(r.Context()))
+		start     = time.Now()
+	)
+	defer close(abandoned)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				s.logPanic(req, rec)
+				done <- result{}
+			}
+		}()
+
+		rec := &recorder{max: s.opts.MaxSize}
+		// Stream responses which are too large to buffer, unless it's an
+		// error and the stale response can be used.
+		rec.attach = func() http.ResponseWriter {
+			if rec.code() >= 500 {
+				return nil
+			}
+			select {
+			case want <- struct{}{}:
+				s.debug(w, "response is streamed or larger than MaxSize")
+				return w
+			case <-abandoned:
+				return nil
+			}
+		}
+		serveTagged(next, rec, req)
+		e, reason := s.save(req, key, rec, rec.header)
+		s.opts.Observer.Fill(req, time.Since(start), e != nil)
+		done <- result{rec, e, reason}
+	}()
+
+	var timeout <-chan time.Time
+	if s.opts.Timeout > 0 {
+		t := time.NewTimer(s.opts.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-want:
+		// The handler writes to w directly now, so wait for it to finish.
+		if res := <-done; res.rec == nil {
+			panic(http.ErrAbortHandler)
+		}
+		return nil, ResultMiss
+	case res := <-done:
+		if res.rec == nil || res.rec.code() >= 500 {
+			s.debug(w, "handler failed; serving stale response")
+			writeEntry(w, r, stale, ResultStale)
+			return nil, ResultStale
+		}
+		s.debug(w, res.reason)
+		res.rec.flush(w)
+		return res.entry, ResultMiss
+	case <-timeout:
+		s.debug(w, "handler timed out; serving stale response")
+		writeEntry(w, r, stale, ResultStale)
+		return nil, ResultStale
+	}
+}
+
+// logPanic logs a panic in a background handler. http.ErrAbortHandler is
+// ignored, as there is no response to abort.
+func (s *server) logPanic(r *http.Request, rec interface{}) {
+	if rec == http.ErrAbortHandler {
+		return
+	}
+	s.opts.Log(r, fmt.Errorf("panic: %v\n%s", rec, debug.Stack()))
+}
+
+// refresh the cached response for key in the background, unless there is
+// already a request for it.
+func (s *server) refresh(next http.Handler, r *http.Request, key string) {
+	f, leader := s.join(key, false)
+	if !leader {
+		return
+	}
+
+	req := r.Clone(detach(r.Context()))
+	req.Method = http.MethodGet
+	go func() {
+		defer s.finish(key, f)
+		defer func() {
+			if rec := recover(); rec != nil {
+				s.logPanic(req, rec)
+			}
+		}()
+
+		start := time.Now()
+		rec := &recorder{max: s.opts.MaxSize}
+		serveTagged(next, rec, req)
+
+		// Keep the stale response if refreshing failed.
+		if rec.code() < 500 {
+			f.entry, _ = s.save(req, key, rec, rec.header)
+		}
+		s.opts.Observer.Fill(req, time.Since(start), f.entry != nil)
+	}()
+}
+
+// save the response in rec with the given headers, if it's cacheable. It
+// returns the entry, or nil and the reason if the response wasn't stored.
+func (s *server) save(r *http.Request, key string, rec *recorder, header http.Header) (*Entry, string) {
+	if rec.streaming || rec.discarded {
+		return nil, "response is streamed or larger than MaxSize"
+	}
+	e := &Entry{
+		Status: rec.code(),
+		Header: header,
+		Body:   append([]byte(nil), rec.body.Bytes()...),
+		Stored: now(),
+		Tags:   strings.Fields(header.Get("Surrogate-Key")),
+	}
+	if int64(len(e.Body)) > s.opts.MaxSize {
+		return nil, "response is larger than MaxSize"
+	}
+
+	fresh, reason := s.ttl(r, e)
+	if reason != "" {
+		return nil, reason
+	}
+	swr, sie := s.grace(e)
+	e.Expires = e.Stored.Add(fresh)
+	e.StaleWhileRevalidate = e.Expires.Add(swr)
+	e.StaleIfError = e.Expires.Add(sie)
+
+	ttl := fresh + swr
+	if sie > swr {
+		ttl = fresh + sie
+	}
+
+	vary := varyHeaders(e.Header)
+	if len(vary) > 0 {
+		err := s.opts.Store.Set(r.Context(), key, &Entry{Vary: vary, Stored: e.Stored, Expires: e.Expires, Tags: e.Tags}, ttl)
+		if err != nil {
+			s.opts.Log(r, err)
+			return nil, "store error"
+		}
+		key = variantKey(key, vary, r)
+	}
+	if err := s.opts.Store.Set(r.Context(), key, e, ttl); err != nil {
+		s.opts.Log(r, err)
+		return nil, "store error"
+	}
+
+	// Waiting requests may send different values for the Vary headers.
+	if len(vary) > 0 {
+		return &Entry{Vary: vary}, ""
+	}
+	return e, ""
+}
+
+// debug sets the X-Cache-Debug header if Debug is enabled.
+func (s *server) debug(w http.ResponseWriter, reason string) {
+	if s.opts.Debug && reason != "" {
+		w.Header().Set("X-Cache-Debug", reason)
+	}
+}
+
+// grace gets how long a stale response can be used while revalidating, and if
+// there is an error. The stale-while-revalidate and stale-if-error directives
+// take precedence over the options.
+func (s *server) grace(e *Entry) (swr, sie time.Duration) {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	for _, d := range []string{"must-revalidate", "proxy-revalidate"} {
+		if _, ok := cc[d]; ok {
+			return 0, 0
+		}
+	}
+
+	swr, sie = s.opts.StaleWhileRevalidate, s.opts.StaleIfError
+	if v, ok := cc["stale-while-revalidate"]; ok {
+		swr, _ = parseSeconds(v)
+	}
+	if v, ok := cc["stale-if-error"]; ok {
+		sie, _ = parseSeconds(v)
+	}
+	return swr, sie
+}
+
+// detached is a context which is never canceled, but keeps the values of the
+// parent.
+type detached struct{ context.Context }
+
+func detach(ctx context.Context) context.Context { return detached{ctx} }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// cacheableStatus are the status codes which can be cached.
+//
+// See: https://www.rfc-editor.org/rfc/rfc9110#section-15.1
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// ttl gets how long the response can be cached for; it returns the reason if
+// it can't be cached.
+func (s *server) ttl(r *http.Request, e *Entry) (time.Duration, string) {
+	if !cacheableStatus[e.Status] {
+		return 0, fmt.Sprintf("status %d is not cacheable", e.Status)
+	}
+	if len(e.Header["Set-Cookie"]) > 0 {
+		return 0, "response has a Set-Cookie header"
+	}
+	if sliceutil.Contains(varyHeaders(e.Header), "*") {
+		return 0, "response has Vary: *"
+	}
+
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return 0, "response has Cache-Control: " + d
+		}
+	}
+	_, public := cc["public"]
+	sMaxAge, hasSMaxAge := cc["s-maxage"]
+	if r.Header.Get("Authorization") != "" && !public && !hasSMaxAge {
+		return 0, "request has an Authorization header and response is not public"
+	}
+
+	if hasSMaxAge {
+		return directiveTTL("s-maxage", sMaxAge)
+	}
+	if maxAge, ok := cc["max-age"]; ok {
+		return directiveTTL("max-age", maxAge)
+	}
+	if exp := e.Header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return 0, "response has an invalid Expires header"
+		}
+		if !t.After(e.Stored) {
+			return 0, "response Expires is in the past"
+		}
+		return t.Sub(e.Stored), ""
+	}
+	if s.opts.DefaultTTL <= 0 {
+		return 0, "response has no max-age, s-maxage, or Expires header"
+	}
+	return s.opts.DefaultTTL, ""
+}
+
+func directiveTTL(name, value string) (time.Duration, string) {
+	d, ok := parseSeconds(value)
+	if !ok {
+		return 0, fmt.Sprintf("response has Cache-Control: %s=%s", name, value)
+	}
+	return d, ""
+}
+
+func parseSeconds(s string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// parseCacheControl parses a Cache-Control header in to a map of directives
+// to their (possibly empty) values. Directive names are lower-cased.
+func parseCacheControl(h string) map[string]string {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(h, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		k, v := d, ""
+		if i := strings.IndexByte(d, '='); i >= 0 {
+			k, v = d[:i], strings.Trim(d[i+1:], `"`)
+		}
+		cc[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+	return cc
+}
+
+// varyHeaders gets the canonical, sorted list of header names from the Vary
+// header.
+func varyHeaders(h http.Header) []string {
+	var vary []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+// variantKey gets the key for a response with a Vary header.
+func variantKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// headerDiff gets all headers in after which are different from before.
+func headerDiff(before, after http.Header) http.Header {
+	diff := make(http.Header)
+	for k, v := range after {
+		if !equalValues(before[k], v) {
+			diff[k] = append([]string(nil), v...)
+		}
+	}
+	return diff
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeEntry writes a cached response.
+func writeEntry(w http.ResponseWriter, r *http.Request, e *Entry, res Result) {
+	for k, v := range e.Header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	age := now().Sub(e.Stored) / time.Second
+	if age < 0 {
+		age = 0
+	}
+	w.Header().Set("X-Cache", string(res))
+	w.Header().Set("Age", strconv.FormatInt(int64(age), 10))
+	if bodyAllowed(e.Status) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(e.Body)))
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.Body)
+	}
+}
@@ -0,0 +1,537 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teamwork/test"
+)
+
+// counter counts the number of calls, and responds with the count.
+type counter struct {
+	calls  int32
+	header http.Header
+	status int
+	delay  time.Duration
+}
+
+func (c *counter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&c.calls, 1)
+	time.Sleep(c.delay)
+	for k, v := range c.header {
+		w.Header()[k] = v
+	}
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+	}
+	_, _ = fmt.Fprintf(w, "call %d lang %s", n, r.Header.Get("Accept-Language"))
+}
+
+func get(t *testing.T, h http.Handler, header http.Header) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/path?q=1", nil)
+	if err != nil {
+		t.Fatalf("cannot make request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return test.HTTP(t, req, h)
+}
+
+func TestServer(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    http.Header // Response header.
+		status    int
+		reqHeader http.Header
+		wantBody  string // Of the second request.
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, 0, nil, "call 1 lang "},
+		{"s-maxage", http.Header{"Cache-Control": {"s-maxage=60"}}, 0, nil, "call 1 lang "},
+		{"expires", http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, 0, nil, "call 1 lang "},
+		{"404", http.Header{"Cache-Control": {"max-age=60"}}, 404, nil, "call 1 lang "},
+		{"no header", nil, 0, nil, "call 2 lang "},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 0, nil, "call 2 lang "},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 0, nil, "call 2 lang "},
+		{"cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 0, nil, "call 2 lang "},
+		{"500", http.Header{"Cache-Control": {"max-age=60"}}, 500, nil, "call 2 lang "},
+		{"vary *", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept, *"}}, 0, nil, "call 2 lang "},
+		{"authorization", http.Header{"Cache-Control": {"max-age=60"}}, 0,
+			http.Header{"Authorization": {"x"}}, "call 2 lang "},
+		{"authorization public", http.Header{"Cache-Control": {"public, max-age=60"}}, 0,
+			http.Header{"Authorization": {"x"}}, "call 1 lang "},
+		{"request no-cache", http.Header{"Cache-Control": {"max-age=60"}}, 0,
+			http.Header{"Cache-Control": {"no-cache"}}, "call 2 lang "},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &counter{header: tc.header, status: tc.status}
+			h := Server(ServerOptions{Store: NewMemoryStore(1 << 20)})(c)
+
+			get(t, h, tc.reqHeader)
+			rr := get(t, h, tc.reqHeader)
+			if b := rr.Body.String(); b != tc.wantBody {
+				t.Errorf("body wrong\nout:  %#v\nwant: %#v", b, tc.wantBody)
+			}
+			wantStatus := tc.status
+			if wantStatus == 0 {
+				wantStatus = 200
+			}
+			if rr.Code != wantStatus {
+				t.Errorf("want code %v, got %v", wantStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestServerVary(t *testing.T) {
+	c := &counter{header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}}
+	h := Server(ServerOptions{Store: NewMemoryStore(1 << 20)})(c)
+
+	for _, tc := range []struct{ lang, want string }{
+		{"en", "call 1 lang en"},
+		{"nl", "call 2 lang nl"},
+		{"en", "call 1 lang en"},
+		{"nl", "call 2 lang nl"},
+	} {
+		rr := get(t, h, http.Header{"Accept-Language": {tc.lang}})
+		if b := rr.Body.String(); b != tc.want {
+			t.Errorf("body wrong\nout:  %#v\nwant: %#v", b, tc.want)
+		}
+		if v := rr.Header().Get("Vary"); v != "Accept-Language" {
+			t.Errorf("Vary wrong: %#v", v)
+		}
+	}
+}
+
+func TestServerExpire(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	c := &counter{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	h := Server(ServerOptions{Store: NewMemoryStore(1 << 20)})(c)
+
+	get(t, h, nil)
+	now = func() time.Time { return start.Add(59 * time.Second) }
+	if b := get(t, h, nil).Body.String(); b != "call 1 lang " {
+		t.Errorf("body wrong: %#v", b)
+	}
+	now = func() time.Time { return start.Add(61 * time.Second) }
+	if b := get(t, h, nil).Body.String(); b != "call 2 lang " {
+		t.Errorf("body wrong: %#v", b)
+	}
+}
+
+func TestServerCoalesce(t *testing.T) {
+	c := &counter{header: http.Header{"Cache-Control": {"max-age=60"}}, delay: 50 * time.Millisecond}
+	h := Server(ServerOptions{Store: NewMemoryStore(1 << 20)})(c)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/path", nil))
+			if b := rr.Body.String(); b != "call 1 lang " {
+				t.Errorf("body wrong: %#v", b)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c.calls != 1 {
+		t.Errorf("handler called %d times", c.calls)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore(300)
+	e := func(body string) *Entry { return &Entry{Body: []byte(body)} }
+
+	_ = s.Set(ctx, "a", e("aaaaaaaaaa"), time.Minute)
+	_ = s.Set(ctx, "b", e("bbbbbbbbbb"), time.Minute)
+	_ = s.Set(ctx, "c", e("cccccccccc"), time.Minute)
+	if s.Len() != 3 {
+		t.Fatalf("want 3 entries, got %d", s.Len())
+	}
+
+	// Use a, so b is the least recently used.
+	if got, _ := s.Get(ctx, "a"); got == nil {
+		t.Fatal("a not found")
+	}
+	_ = s.Set(ctx, "d", e("dddddddddddddddddddddddddddddddddddddddddddddddddd"), time.Minute)
+	if got, _ := s.Get(ctx, "b"); got != nil {
+		t.Error("b not evicted")
+	}
+	if got, _ := s.Get(ctx, "a"); got == nil {
+		t.Error("a evicted")
+	}
+	if s.Size() > 300 {
+		t.Errorf("size too large: %d", s.Size())
+	}
+
+	// Too large to ever fit.
+	_ = s.Set(ctx, "e", &Entry{Body: make([]byte, 500)}, time.Minute)
+	if got, _ := s.Get(ctx, "e"); got != nil {
+		t.Error("e stored")
+	}
+
+	_ = s.Delete(ctx, "a")
+	if got, _ := s.Get(ctx, "a"); got != nil {
+		t.Error("a not deleted")
+	}
+}
+
+// flaky responds with the call count, or an error after the first call.
+type flaky struct {
+	calls  int32
+	fail   bool
+	header string
+	block  chan struct{}
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&f.calls, 1)
+	w.Header().Set("Cache-Control", f.header)
+	if n > 1 && f.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n > 1 && f.block != nil {
+		<-f.block
+	}
+	_, _ = fmt.Fprintf(w, "call %d", n)
+}
+
+func TestServerStale(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+
+	cases := []struct {
+		name     string
+		handler  *flaky
+		opts     ServerOptions
+		wantCode int
+		wantBody string
+	}{
+		{"expired", &flaky{header: "max-age=60"}, ServerOptions{}, 200, "call 2"},
+		{"stale-if-error", &flaky{header: "max-age=60", fail: true},
+			ServerOptions{StaleIfError: time.Hour}, 200, "call 1"},
+		{"stale-if-error directive", &flaky{header: "max-age=60, stale-if-error=3600", fail: true},
+			ServerOptions{}, 200, "call 1"},
+		{"stale-if-error expired", &flaky{header: "max-age=60", fail: true},
+			ServerOptions{StaleIfError: time.Second}, 500, ""},
+		{"must-revalidate", &flaky{header: "max-age=60, must-revalidate", fail: true},
+			ServerOptions{StaleIfError: time.Hour}, 500, ""},
+		{"stale-if-error ok", &flaky{header: "max-age=60"},
+			ServerOptions{StaleIfError: time.Hour}, 200, "call 2"},
+		{"timeout", &flaky{header: "max-age=60", block: make(chan struct{})},
+			ServerOptions{StaleIfError: time.Hour, Timeout: 10 * time.Millisecond}, 200, "call 1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now = func() time.Time { return start }
+			store := &notifyStore{NewMemoryStore(1 << 20), make(chan struct{}, 10)}
+			tc.opts.Store = store
+			h := Server(tc.opts)(tc.handler)
+
+			get(t, h, nil)
+			now = func() time.Time { return start.Add(90 * time.Second) }
+			rr := get(t, h, nil)
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %v, got %v", tc.wantCode, rr.Code)
+			}
+			if b := rr.Body.String(); b != tc.wantBody {
+				t.Errorf("body wrong\nout:  %#v\nwant: %#v", b, tc.wantBody)
+			}
+
+			// The handler should finish in the background and store the
+			// response.
+			if tc.handler.block != nil {
+				<-store.set
+				close(tc.handler.block)
+				select {
+				case <-store.set:
+				case <-time.After(5 * time.Second):
+					t.Error("response not stored")
+				}
+			}
+		})
+	}
+}
+
+// notifyStore sends on set after every Set().
+type notifyStore struct {
+	Store
+	set chan struct{}
+}
+
+func (s *notifyStore) Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error {
+	err := s.Store.Set(ctx, key, e, ttl)
+	s.set <- struct{}{}
+	return err
+}
+
+// waitFor waits until h responds with want.
+func waitFor(t *testing.T, h http.Handler, want string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if b := get(t, h, nil).Body.String(); b == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("no response with %#v", want)
+}
+
+func TestServerStaleWhileRevalidate(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	f := &flaky{header: "max-age=60, stale-while-revalidate=60"}
+	h := Server(ServerOptions{Store: NewMemoryStore(1 << 20)})(f)
+
+	get(t, h, nil)
+	now = func() time.Time { return start.Add(90 * time.Second) }
+	if b := get(t, h, nil).Body.String(); b != "call 1" {
+		t.Errorf("stale response not served: %#v", b)
+	}
+
+	// Wait for the background refresh.
+	waitFor(t, h, "call 2")
+}
+
+func TestServerHeaders(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	f := &flaky{header: "max-age=60, stale-while-revalidate=60"}
+	o := fillObserver{fill: make(chan bool, 10)}
+	h := Server(ServerOptions{Store: NewMemoryStore(1 << 20), Observer: o})(f)
+
+	for _, tc := range []struct {
+		after   time.Duration
+		wantRes string
+		wantAge string
+	}{
+		{0, "MISS", ""},
+		{30 * time.Second, "HIT", "30"},
+		{90 * time.Second, "STALE", "90"},
+	} {
+		now = func() time.Time { return start.Add(tc.after) }
+		rr := get(t, h, nil)
+		if x := rr.Header().Get("X-Cache"); x != tc.wantRes {
+			t.Errorf("%v: X-Cache wrong: %#v", tc.after, x)
+		}
+		if a := rr.Header().Get("Age"); a != tc.wantAge {
+			t.Errorf("%v: Age wrong: %#v", tc.after, a)
+		}
+	}
+
+	// Wait for the fill and the background refresh, which use now.
+	<-o.fill
+	<-o.fill
+}
+
+func TestServerDebug(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    http.Header
+		status    int
+		reqHeader http.Header
+		want      string
+	}{
+		{"cached", http.Header{"Cache-Control": {"max-age=60"}}, 0, nil, ""},
+		{"no header", nil, 0, nil, "response has no max-age, s-maxage, or Expires header"},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 0, nil, "response has Cache-Control: private"},
+		{"cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 0, nil, "response has a Set-Cookie header"},
+		{"500", http.Header{"Cache-Control": {"max-age=60"}}, 500, nil, "status 500 is not cacheable"},
+		{"max-age=0", http.Header{"Cache-Control": {"max-age=0"}}, 0, nil, "response has Cache-Control: max-age=0"},
+		{"expires", http.Header{"Expires": {"Thu, 01 Jan 1970 00:00:00 GMT"}}, 0, nil, "response Expires is in the past"},
+		{"authorization", http.Header{"Cache-Control": {"max-age=60"}}, 0,
+			http.Header{"Authorization": {"x"}}, "request has an Authorization header and response is not public"},
+		{"request no-store", http.Header{"Cache-Control": {"max-age=60"}}, 0,
+			http.Header{"Cache-Control": {"no-store"}}, "request has Cache-Control: no-store"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &counter{header: tc.header, status: tc.status}
+			h := Server(ServerOptions{Store: NewMemoryStore(1 << 20), Debug: true})(c)
+
+			rr := get(t, h, tc.reqHeader)
+			if d := rr.Header().Get("X-Cache-Debug"); d != tc.want {
+				t.Errorf("X-Cache-Debug wrong\nout:  %#v\nwant: %#v", d, tc.want)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		h := Server(ServerOptions{Store: NewMemoryStore(1 << 20)})(&counter{})
+		if d := get(t, h, nil).Header().Get("X-Cache-Debug"); d != "" {
+			t.Errorf("X-Cache-Debug set: %#v", d)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	var (
+		m     = &Metrics{}
+		store = NewMemoryStore(300)
+		c     = &counter{header: http.Header{"Cache-Control": {"max-age=60"}}}
+		h     = Server(ServerOptions{Store: store, Observer: m})(c)
+	)
+	for _, u := range []string{"/a", "/a", "/a", "/b", "/c", "/d"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", u, nil))
+	}
+
+	st := m.Stats()
+	if st.Hits != 2 || st.Misses != 4 || st.Stale != 0 {
+		t.Errorf("wrong counts: %+v", st)
+	}
+	if r := st.HitRatio(); r < 0.33 || r > 0.34 {
+		t.Errorf("wrong hit ratio: %v", r)
+	}
+	if st.Fills != 4 || st.Stored != 4 || st.FillTime <= 0 || st.AvgFillTime() <= 0 {
+		t.Errorf("wrong fills: %+v", st)
+	}
+	if st.Evictions == 0 {
+		t.Errorf("no evictions: %+v", st)
+	}
+	if st.Entries != int64(store.Len()) || st.Bytes != store.Size() {
+		t.Errorf("wrong size: %+v; store has %d entries and %d bytes", st, store.Len(), store.Size())
+	}
+}
+
+// large responds with a small body on the first call, and a body larger than
+// 100 bytes after that.
+type large struct {
+	calls  int32
+	header string
+	status int
+	panic  bool
+}
+
+func (l *large) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&l.calls, 1)
+	w.Header().Set("Cache-Control", l.header)
+	if n == 1 {
+		_, _ = w.Write([]byte("small"))
+		return
+	}
+	if l.panic {
+		panic("oh noes")
+	}
+	if l.status != 0 {
+		w.WriteHeader(l.status)
+	}
+	for i := 0; i < 10; i++ {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 50))
+	}
+}
+
+func TestServerStaleLarge(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+
+	cases := []struct {
+		name     string
+		handler  *large
+		wantCode int
+		wantBody string
+		wantLog  string
+	}{
+		{"streamed", &large{header: "max-age=60"}, 200, strings.Repeat("x", 500), ""},
+		{"error", &large{header: "max-age=60", status: 500}, 200, "small", ""},
+		{"panic", &large{header: "max-age=60", panic: true}, 200, "small", "panic: oh noes\ngoroutine "},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logged []string
+			now = func() time.Time { return start }
+			h := Server(ServerOptions{
+				Store:        NewMemoryStore(1 << 20),
+				MaxSize:      100,
+				StaleIfError: time.Hour,
+				Log:          func(_ *http.Request, err error) { logged = append(logged, err.Error()) },
+			})(tc.handler)
+
+			get(t, h, nil)
+			now = func() time.Time { return start.Add(90 * time.Second) }
+			for i := 0; i < 2; i++ {
+				rr := get(t, h, nil)
+				if rr.Code != tc.wantCode {
+					t.Errorf("want code %v, got %v", tc.wantCode, rr.Code)
+				}
+				if b := rr.Body.String(); b != tc.wantBody {
+					t.Errorf("body wrong\nout:  %#v\nwant: %#v", b, tc.wantBody)
+				}
+				// Buffered responses get a Content-Length.
+				if cl := rr.Header().Get("Content-Length"); (cl == "") != (tc.name == "streamed") {
+					t.Errorf("wrong Content-Length: %#v", cl)
+				}
+			}
+
+			// The large response is never stored, so the handler runs every
+			// time.
+			if n := atomic.LoadInt32(&tc.handler.calls); n != 3 {
+				t.Errorf("handler called %d times", n)
+			}
+			if tc.wantLog != "" && (len(logged) == 0 || !strings.HasPrefix(logged[0], tc.wantLog)) {
+				t.Errorf("wrong log: %#v", logged)
+			}
+		})
+	}
+}
+
+// fillObserver sends on fill after every fill.
+type fillObserver struct {
+	nopObserver
+	fill chan bool
+}
+
+func (o fillObserver) Fill(_ *http.Request, _ time.Duration, stored bool) { o.fill <- stored }
+
+func TestServerStaleWhileRevalidateLarge(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	l := &large{header: "max-age=60, stale-while-revalidate=60"}
+	o := fillObserver{fill: make(chan bool, 10)}
+	h := Server(ServerOptions{Store: NewMemoryStore(1 << 20), MaxSize: 100, Observer: o})(l)
+
+	get(t, h, nil)
+	if !<-o.fill {
+		t.Fatal("small response not stored")
+	}
+	now = func() time.Time { return start.Add(90 * time.Second) }
+	if b := get(t, h, nil).Body.String(); b != "small" {
+		t.Errorf("stale response not served: %#v", b)
+	}
+
+	// The background refresh is too large to store, so the stale response is
+	// kept.
+	if <-o.fill {
+		t.Error("large response stored")
+	}
+	if b := get(t, h, nil).Body.String(); b != "small" {
+		t.Errorf("stale response not served: %#v", b)
+	}
+	<-o.fill
+}
@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a cached response.
+type Entry struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+
+	// Stored is when the response was generated.
+	Stored time.Time `json:"stored"`
+
+	// Expires is when the response becomes stale.
+	Expires time.Time `json:"expires"`
+
+	// StaleWhileRevalidate and StaleIfError are when the stale response can
+	// no longer be served while refreshing, or if there is an error.
+	StaleWhileRevalidate time.Time `json:"staleWhileRevalidate"`
+	StaleIfError         time.Time `json:"staleIfError"`
+
+	// Vary is set on placeholder entries for responses with a Vary header;
+	// the actual response is stored under a key which includes the values of
+	// these request headers.
+	Vary []string `json:"vary,omitempty"`
+
+	// Tags are the surrogate keys from Tag() or the Surrogate-Key header.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// size is the approximate memory usage of the entry.
+func (e *Entry) size() int64 {
+	s := int64(len(e.Body)) + 64
+	for k, v := range e.Header {
+		s += int64(len(k))
+		for _, vv := range v {
+			s += int64(len(vv))
+		}
+	}
+	for _, v := range e.Vary {
+		s += int64(len(v))
+	}
+	for _, t := range e.Tags {
+		s += int64(len(t))
+	}
+	return s
+}
+
+// Store stores cached responses for the Server middleware.
+//
+// Entries returned by Get are shared and must not be modified.
+type Store interface {
+	// Get an entry; it returns nil if there is no entry for key.
+	Get(ctx context.Context, key string) (*Entry, error)
+
+	// Set an entry, which should be removed after ttl.
+	Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error
+
+	// Delete an entry.
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryStore is an in-memory LRU store with a size limit.
+type MemoryStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+	tags  map[string]map[string]struct{}
+
+	observers []Observer
+	evicted   []string // Not reported yet.
+}
+
+type memoryItem struct {
+	key     string
+	entry   *Entry
+	size    int64
+	expires time.Time
+}
+
+// NewMemoryStore creates a new in-memory store which holds at most maxBytes of
+// responses; the least recently used entries are removed when it's full.
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		tags:     make(map[string]map[string]struct{}),
+	}
+}
+
+// Get an entry.
+func (s *MemoryStore) Get(_ context.Context, key string) (*Entry, error) {
+	defer s.report()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, nil
+	}
+	it := el.Value.(*memoryItem)
+	if !now().Before(it.expires) {
+		s.remove(el)
+		return nil, nil
+	}
+	s.ll.MoveToFront(el)
+	return it.entry, nil
+}
+
+// Set an entry. Entries larger than the store's maximum size are ignored.
+func (s *MemoryStore) Set(_ context.Context, key string, e *Entry, ttl time.Duration) error {
+	it := &memoryItem{
+		key:     key,
+		entry:   e,
+		size:    e.size() + int64(len(key)),
+		expires: now().Add(ttl),
+	}
+
+	defer s.report()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	if it.size > s.maxBytes {
+		return nil
+	}
+
+	s.items[key] = s.ll.PushFront(it)
+	s.size += it.size
+	for _, t := range e.Tags {
+		if s.tags[t] == nil {
+			s.tags[t] = make(map[string]struct{})
+		}
+		s.tags[t][key] = struct{}{}
+	}
+	for s.size > s.maxBytes {
+		el := s.ll.Back()
+		if len(s.observers) > 0 {
+			s.evicted = append(s.evicted, el.Value.(*memoryItem).key)
+		}
+		s.remove(el)
+	}
+	return nil
+}
+
+// Delete an entry.
+func (s *MemoryStore) Delete(_ context.Context, key string) error {
+	defer s.report()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+// PurgeTags removes all entries with any of the tags.
+func (s *MemoryStore) PurgeTags(_ context.Context, tags ...string) (int, error) {
+	defer s.report()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, t := range tags {
+		for key := range s.tags[t] {
+			if el, ok := s.items[key]; ok {
+				s.remove(el)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// PurgePrefix removes all entries with a key starting with prefix.
+func (s *MemoryStore) PurgePrefix(_ context.Context, prefix string) (int, error) {
+	defer s.report()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for key, el := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(el)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Len gets the number of entries.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+// Size gets the total size of all entries, in bytes.
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *MemoryStore) observe(o Observer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, o)
+}
+
+// report evictions and the size to the observers; must not hold the lock.
+func (s *MemoryStore) report() {
+	s.mu.Lock()
+	var (
+		observers = s.observers
+		evicted   = s.evicted
+		n, size   = s.ll.Len(), s.size
+	)
+	s.evicted = nil
+	s.mu.Unlock()
+
+	for _, o := range observers {
+		for _, k := range evicted {
+			o.Evict(k)
+		}
+		o.Size(n, size)
+	}
+}
+
+// remove an element; must hold the lock.
+func (s *MemoryStore) remove(el *list.Element) {
+	it := s.ll.Remove(el).(*memoryItem)
+	delete(s.items, it.key)
+	s.size -= it.size
+	for _, t := range it.entry.Tags {
+		delete(s.tags[t], it.key)
+		if len(s.tags[t]) == 0 {
+			delete(s.tags, t)
+		}
+	}
+}
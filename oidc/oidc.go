@@ -0,0 +1,445 @@
+// Package oidc adds an OpenID Connect relying-party login flow.
+//
+// It implements the authorization code flow with PKCE: unauthenticated
+// requests are redirected to the provider, the callback exchanges the code for
+// an ID token which is validated against the provider's JWKS, and a signed
+// session cookie is set.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html
+package oidc // import "github.com/teamwork/middleware/oidc"
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Options for the middleware.
+type Options struct {
+	// ClientID and ClientSecret as registered with the provider. The secret
+	// may be empty for public clients.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the absolute callback URL registered with the provider,
+	// e.g. "https://example.com/oidc/callback". The path of this URL is
+	// handled by the middleware.
+	RedirectURL string
+
+	// DiscoveryURL is the location of the provider's discovery document, e.g.
+	// "https://accounts.example.com/.well-known/openid-configuration".
+	DiscoveryURL string
+
+	// JWKSURL overrides the jwks_uri from the discovery document.
+	JWKSURL string
+
+	// Scopes to request; "openid" is always added.
+	Scopes []string
+
+	// SessionKey is used to sign the session and state cookies; it should be
+	// at least 32 random bytes.
+	SessionKey []byte
+
+	// SessionCookie is the name of the session cookie; defaults to
+	// "oidc_session". The state cookie uses the same name with a "_state"
+	// suffix.
+	SessionCookie string
+
+	// SessionMaxAge is how long a session is valid; defaults to the expiry of
+	// the ID token.
+	SessionMaxAge time.Duration
+
+	// Insecure allows setting cookies without the Secure flag, for local
+	// development over http.
+	Insecure bool
+
+	// Client is the HTTP client used to talk to the provider; defaults to a
+	// client with a 10 second timeout.
+	Client *http.Client
+
+	// Log errors; defaults to printing to stderr.
+	Log func(*http.Request, error)
+}
+
+// Session is the authenticated user, as stored in the session cookie.
+type Session struct {
+	Subject   string `json:"sub"`
+	Email     string `json:"email,omitempty"`
+	Name      string `json:"name,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type ctxKey struct{}
+
+// FromContext gets the session set by Login, or nil if there is none.
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(ctxKey{}).(*Session)
+	return s
+}
+
+// Login requires an authenticated session for all requests; unauthenticated
+// requests are redirected to the provider.
+func Login(opts Options) func(http.Handler) http.Handler {
+	if opts.ClientID == "" {
+		panic("middleware/oidc: ClientID is empty")
+	}
+	if len(opts.SessionKey) == 0 {
+		panic("middleware/oidc: SessionKey is empty")
+	}
+	redirect, err := url.Parse(opts.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		panic(fmt.Sprintf("middleware/oidc: RedirectURL %q is not an absolute URL", opts.RedirectURL))
+	}
+	if opts.DiscoveryURL == "" {
+		panic("middleware/oidc: DiscoveryURL is empty")
+	}
+	if opts.SessionCookie == "" {
+		opts.SessionCookie = "oidc_session"
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Log == nil {
+		opts.Log = func(r *http.Request, err error) {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: %v\n", r.URL.Path, err)
+		}
+	}
+
+	p := &provider{opts: &opts}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == redirect.Path {
+				p.callback(w, r)
+				return
+			}
+
+			if s := p.session(r); s != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, s)))
+				return
+			}
+
+			p.redirect(w, r)
+		})
+	}
+}
+
+// Logout clears the session cookie and redirects to returnTo.
+func Logout(opts Options, returnTo string) http.Handler {
+	if opts.SessionCookie == "" {
+		opts.SessionCookie = "oidc_session"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     opts.SessionCookie,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   !opts.Insecure,
+		})
+		http.Redirect(w, r, returnTo, http.StatusFound)
+	})
+}
+
+// discovery is the subset of the discovery document we use.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// state is stored in a cookie while the user is at the provider.
+type state struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+}
+
+type provider struct {
+	opts *Options
+
+	mu        sync.Mutex
+	disc      *discovery
+	keys      map[string]interface{}
+	keysFetch time.Time
+}
+
+func (p *provider) session(r *http.Request) *Session {
+	c, err := r.Cookie(p.opts.SessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	var s Session
+	if err := verifyCookie(p.opts.SessionKey, c.Value, &s); err != nil {
+		return nil
+	}
+	if time.Now().Unix() >= s.ExpiresAt {
+		return nil
+	}
+	return &s
+}
+
+func (p *provider) redirect(w http.ResponseWriter, r *http.Request) {
+	d, err := p.discovery(r.Context())
+	if err != nil {
+		p.opts.Log(r, err)
+		http.Error(w, "Could not contact login provider.", http.StatusBadGateway)
+		return
+	}
+
+	st := state{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString() + randomString(),
+		Return:   r.URL.RequestURI(),
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		st.Return = "/"
+	}
+
+	v, err := signCookie(p.opts.SessionKey, st)
+	if err != nil {
+		p.opts.Log(r, err)
+		http.Error(w, "Could not start login.", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.opts.SessionCookie + "_state",
+		Value:    v,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   !p.opts.Insecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.opts.ClientID},
+		"redirect_uri":          {p.opts.RedirectURL},
+		"scope":                 {p.scope()},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func (p *provider) callback(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(p.opts.SessionCookie + "_state")
+	if err != nil {
+		http.Error(w, "Login expired; please try again.", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.opts.SessionCookie + "_state",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   !p.opts.Insecure,
+	})
+
+	var st state
+	if err := verifyCookie(p.opts.SessionKey, c.Value, &st); err != nil {
+		p.opts.Log(r, errors.Wrap(err, "invalid state cookie"))
+		http.Error(w, "Login expired; please try again.", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		p.opts.Log(r, errors.Errorf("provider returned error %q: %s", e, q.Get("error_description")))
+		http.Error(w, "Login failed.", http.StatusUnauthorized)
+		return
+	}
+	if q.Get("state") != st.State {
+		p.opts.Log(r, errors.New("state mismatch"))
+		http.Error(w, "Login failed.", http.StatusBadRequest)
+		return
+	}
+
+	d, err := p.discovery(r.Context())
+	if err != nil {
+		p.opts.Log(r, err)
+		http.Error(w, "Could not contact login provider.", http.StatusBadGateway)
+		return
+	}
+
+	rawToken, err := p.exchange(r.Context(), d, q.Get("code"), st.Verifier)
+	if err != nil {
+		p.opts.Log(r, err)
+		http.Error(w, "Login failed.", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := p.verify(r.Context(), d, rawToken, st.Nonce)
+	if err != nil {
+		p.opts.Log(r, errors.Wrap(err, "invalid ID token"))
+		http.Error(w, "Login failed.", http.StatusUnauthorized)
+		return
+	}
+
+	s := Session{
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		Name:      claims.Name,
+		ExpiresAt: claims.Expiry,
+	}
+	if p.opts.SessionMaxAge > 0 {
+		s.ExpiresAt = time.Now().Add(p.opts.SessionMaxAge).Unix()
+	}
+
+	v, err := signCookie(p.opts.SessionKey, s)
+	if err != nil {
+		p.opts.Log(r, err)
+		http.Error(w, "Login failed.", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.opts.SessionCookie,
+		Value:    v,
+		Path:     "/",
+		Expires:  time.Unix(s.ExpiresAt, 0),
+		HttpOnly: true,
+		Secure:   !p.opts.Insecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Only redirect to local paths.
+	ret := st.Return
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") || strings.HasPrefix(ret, "/\\") {
+		ret = "/"
+	}
+	http.Redirect(w, r, ret, http.StatusFound)
+}
+
+func (p *provider) scope() string {
+	scopes := []string{"openid"}
+	for _, s := range p.opts.Scopes {
+		if s != "openid" {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// discovery loads the discovery document, caching it after the first
+// successful load.
+func (p *provider) discovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.disc != nil {
+		return p.disc, nil
+	}
+
+	var d discovery
+	if err := p.getJSON(ctx, p.opts.DiscoveryURL, &d); err != nil {
+		return nil, errors.Wrap(err, "could not load discovery document")
+	}
+	if p.opts.JWKSURL != "" {
+		d.JWKSURI = p.opts.JWKSURL
+	}
+	if d.Issuer == "" || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required fields")
+	}
+
+	p.disc = &d
+	return p.disc, nil
+}
+
+// exchange the authorization code for an ID token.
+func (p *provider) exchange(ctx context.Context, d *discovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.opts.RedirectURL},
+		"client_id":     {p.opts.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "could not create token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.opts.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.opts.ClientID), url.QueryEscape(p.opts.ClientSecret))
+	}
+
+	resp, err := p.opts.Client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "token request failed")
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", errors.Wrap(err, "could not read token response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("token endpoint returned %s: %s", resp.Status, body)
+	}
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", errors.Wrap(err, "could not parse token response")
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+func (p *provider) getJSON(ctx context.Context, u string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("middleware/oidc: could not read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
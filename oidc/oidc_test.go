@@ -0,0 +1,243 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type handle struct{}
+
+func (h handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("hello " + FromContext(r.Context()).Subject))
+}
+
+// fakeProvider is a minimal OpenID provider.
+type fakeProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	codes    map[string]url.Values // code -> authorize request
+	claims   map[string]interface{}
+}
+
+func newFakeProvider(t *testing.T, clientID string) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{key: key, clientID: clientID, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		code := "code-" + r.URL.Query().Get("state")[:8]
+		p.codes[code] = r.URL.Query()
+		http.Redirect(w, r, r.URL.Query().Get("redirect_uri")+"?"+url.Values{
+			"code":  {code},
+			"state": {r.URL.Query().Get("state")},
+		}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		auth, ok := p.codes[r.Form.Get("code")]
+		if !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		h := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(h[:]) != auth.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":   p.URL,
+			"sub":   "user-1",
+			"aud":   p.clientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": auth.Get("nonce"),
+		}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, claims)})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *fakeProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	c, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	hash := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// do a request against h, following redirects and keeping cookies.
+func do(h http.Handler, target string, cookies []*http.Cookie) (*httptest.ResponseRecorder, []*http.Cookie) {
+	req := httptest.NewRequest("GET", target, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	jar := map[string]*http.Cookie{}
+	for _, c := range cookies {
+		jar[c.Name] = c
+	}
+	for _, c := range rr.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(jar, c.Name)
+		} else {
+			jar[c.Name] = c
+		}
+	}
+	cookies = nil
+	for _, c := range jar {
+		cookies = append(cookies, c)
+	}
+	return rr, cookies
+}
+
+func TestLogin(t *testing.T) {
+	cases := []struct {
+		name     string
+		claims   map[string]interface{}
+		wantCode int
+	}{
+		{"ok", nil, http.StatusOK},
+		{"wrong audience", map[string]interface{}{"aud": "other"}, http.StatusUnauthorized},
+		{"wrong issuer", map[string]interface{}{"iss": "https://evil.example.com"}, http.StatusUnauthorized},
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, http.StatusUnauthorized},
+		{"wrong nonce", map[string]interface{}{"nonce": "x"}, http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newFakeProvider(t, "client")
+			defer p.Close()
+			p.claims = tc.claims
+
+			h := Login(Options{
+				ClientID:     "client",
+				RedirectURL:  "http://example.com/oidc/callback",
+				DiscoveryURL: p.URL + "/.well-known/openid-configuration",
+				SessionKey:   []byte("0123456789abcdef0123456789abcdef"),
+				Log:          func(*http.Request, error) {},
+			})(handle{})
+
+			rr, cookies := do(h, "/dashboard?x=1", nil)
+			if rr.Code != http.StatusFound {
+				t.Fatalf("want redirect, got %d: %s", rr.Code, rr.Body.String())
+			}
+			loc := rr.Header().Get("Location")
+			if !strings.HasPrefix(loc, p.URL+"/authorize?") {
+				t.Fatalf("wrong redirect: %s", loc)
+			}
+
+			// Let the provider "log in" the user.
+			resp, err := (&http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}).Get(loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			cb, _ := url.Parse(resp.Header.Get("Location"))
+
+			rr, cookies = do(h, cb.RequestURI(), cookies)
+			if rr.Code != http.StatusFound {
+				if rr.Code != tc.wantCode {
+					t.Fatalf("want code %d, got %d: %s", tc.wantCode, rr.Code, rr.Body.String())
+				}
+				return
+			}
+			if loc := rr.Header().Get("Location"); loc != "/dashboard?x=1" {
+				t.Fatalf("wrong return location: %s", loc)
+			}
+
+			rr, _ = do(h, "/dashboard?x=1", cookies)
+			if rr.Code != tc.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tc.wantCode, rr.Code, rr.Body.String())
+			}
+			if b := rr.Body.String(); b != "hello user-1" {
+				t.Errorf("body wrong: %#v", b)
+			}
+		})
+	}
+}
+
+func TestLoginStateMismatch(t *testing.T) {
+	p := newFakeProvider(t, "client")
+	defer p.Close()
+
+	h := Login(Options{
+		ClientID:     "client",
+		RedirectURL:  "http://example.com/oidc/callback",
+		DiscoveryURL: p.URL + "/.well-known/openid-configuration",
+		SessionKey:   []byte("0123456789abcdef0123456789abcdef"),
+		Log:          func(*http.Request, error) {},
+	})(handle{})
+
+	_, cookies := do(h, "/", nil)
+	rr, _ := do(h, "/oidc/callback?code=x&state=wrong", cookies)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("want code 400, got %d", rr.Code)
+	}
+}
+
+func TestSignCookie(t *testing.T) {
+	key := []byte("key")
+	v, err := signCookie(key, Session{Subject: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Session
+	if err := verifyCookie(key, v, &s); err != nil || s.Subject != "a" {
+		t.Errorf("verify failed: %v %#v", err, s)
+	}
+	if err := verifyCookie([]byte("other"), v, &s); err == nil {
+		t.Error("verify with wrong key succeeded")
+	}
+	if err := verifyCookie(key, "x"+v, &s); err == nil {
+		t.Error("verify of tampered cookie succeeded")
+	}
+}
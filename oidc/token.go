@@ -0,0 +1,261 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/teamwork/utils/v2/sliceutil"
+)
+
+// clockSkew is the leeway when checking token expiry.
+const clockSkew = 2 * time.Minute
+
+// minKeyRefresh is the minimum time between JWKS fetches when we see an
+// unknown key ID, so bogus tokens can't make us hammer the provider.
+const minKeyRefresh = time.Minute
+
+// claims is the subset of ID token claims we use.
+type claims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expiry   int64           `json:"exp"`
+	IssuedAt int64           `json:"iat"`
+	Nonce    string          `json:"nonce"`
+	AZP      string          `json:"azp"`
+	Email    string          `json:"email"`
+	Name     string          `json:"name"`
+}
+
+// audiences returns the aud claim, which can be either a string or a list of
+// strings.
+func (c claims) audiences() []string {
+	var one string
+	if err := json.Unmarshal(c.Audience, &one); err == nil {
+		return []string{one}
+	}
+	var many []string
+	_ = json.Unmarshal(c.Audience, &many)
+	return many
+}
+
+// verify the signature and claims of a raw ID token.
+func (p *provider) verify(ctx context.Context, d *discovery, raw, nonce string) (*claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "could not decode header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode signature")
+	}
+
+	key, err := p.key(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("key %q is not an RSA key", header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig); err != nil {
+			return nil, errors.Wrap(err, "invalid signature")
+		}
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("key %q is not an EC key", header.Kid)
+		}
+		if len(sig) != 64 {
+			return nil, errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, hash[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, errors.Wrap(err, "could not decode claims")
+	}
+
+	now := time.Now()
+	switch {
+	case c.Issuer != d.Issuer:
+		return nil, errors.Errorf("wrong issuer %q", c.Issuer)
+	case !sliceutil.Contains(c.audiences(), p.opts.ClientID):
+		return nil, errors.Errorf("wrong audience %s", c.Audience)
+	case c.AZP != "" && c.AZP != p.opts.ClientID:
+		return nil, errors.Errorf("wrong authorized party %q", c.AZP)
+	case now.Add(-clockSkew).Unix() >= c.Expiry:
+		return nil, errors.New("token expired")
+	case c.IssuedAt > now.Add(clockSkew).Unix():
+		return nil, errors.New("token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("nonce mismatch")
+	case c.Subject == "":
+		return nil, errors.New("token has no subject")
+	}
+
+	return &c, nil
+}
+
+// key gets a public key by ID, fetching the JWKS if we don't have it yet.
+func (p *provider) key(ctx context.Context, d *discovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetch) < minKeyRefresh {
+		return nil, errors.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	p.keysFetch = time.Now()
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, errors.Wrap(err, "could not load JWKS")
+	}
+
+	p.keys = make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = pub
+	}
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errors.Errorf("unknown key %q", kid)
+}
+
+// jwk is a JSON Web Key; see RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return pub, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeSegment(seg string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// signCookie encodes v as JSON and signs it with HMAC-SHA256.
+func signCookie(key []byte, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode cookie")
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac(key, payload)), nil
+}
+
+// verifyCookie checks the signature of a value created by signCookie and
+// decodes it in to dst.
+func verifyCookie(key []byte, value string, dst interface{}) error {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return errors.New("malformed cookie")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return errors.Wrap(err, "malformed cookie")
+	}
+	if !hmac.Equal(sig, mac(key, value[:i])) {
+		return errors.New("invalid cookie signature")
+	}
+	return decodeSegment(value[:i], dst)
+}
+
+func mac(key []byte, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,119 @@
+package rescue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+
+	"github.com/kr/pretty"
+)
+
+// Kind of panic.
+type Kind int
+
+// Panic kinds.
+const (
+	// KindPanic is an unexpected panic; this is the default.
+	KindPanic Kind = iota
+
+	// KindAbort is http.ErrAbortHandler, which is re-panicked to let net/http
+	// abort the response; it is never logged.
+	KindAbort
+
+	// KindDisconnect is a panic caused by the client going away, such as a
+	// canceled request context or a broken pipe. It is only logged if
+	// Config.LogDisconnects is set.
+	KindDisconnect
+
+	// KindHTTPError is a panic with an error that has a StatusCode() method,
+	// such as Error. 4xx errors are not logged.
+	KindHTTPError
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindPanic:
+		return "panic"
+	case KindAbort:
+		return "abort"
+	case KindDisconnect:
+		return "disconnect"
+	case KindHTTPError:
+		return "http error"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// StatusCoder is implemented by errors which carry a HTTP status code.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// Error is a panic value with a HTTP status code. For example:
+//
+//	panic(rescue.NewError(http.StatusNotFound, "No such project."))
+//
+// The message is shown to the user, so it should not contain any sensitive
+// information.
+type Error struct {
+	Status  int
+	Message string
+
+	// Err is the underlying error, if any; it is not shown to the user.
+	Err error
+}
+
+// NewError creates a new Error.
+func NewError(status int, message string) *Error {
+	return &Error{Status: status, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// StatusCode implements StatusCoder.
+func (e *Error) StatusCode() int { return e.Status }
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error { return e.Err }
+
+// panicError converts the recovered value rec to an error.
+func panicError(rec interface{}) error {
+	var err error
+	switch rec := rec.(type) {
+	case error:
+		err = rec
+	case map[string]interface{}:
+		err, _ = rec["error"].(error)
+	}
+	if err == nil {
+		err = pretty.Errorf("%v", rec)
+	}
+	return err
+}
+
+// classify the panic error err, returning the kind and HTTP status code.
+func classify(r *http.Request, err error) (Kind, int) {
+	var sc StatusCoder
+	switch {
+	case errors.Is(err, http.ErrAbortHandler):
+		return KindAbort, 0
+	case errors.As(err, &sc) && sc.StatusCode() >= 400 && sc.StatusCode() <= 599:
+		return KindHTTPError, sc.StatusCode()
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil,
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ECONNRESET):
+		// 499 is nginx's "Client Closed Request"; the client won't see it, but
+		// it's useful in access logs.
+		return KindDisconnect, 499
+	default:
+		return KindPanic, http.StatusInternalServerError
+	}
+}
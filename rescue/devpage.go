@@ -0,0 +1,142 @@
+package rescue
+
+import (
+	"bufio"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+)
+
+// sourceContext is the number of lines to show around each frame on the
+// developer error page.
+const sourceContext = 5
+
+type (
+	devPage struct {
+		Report     Report
+		Frames     []devFrame
+		Headers    []devHeader
+		Goroutines string
+	}
+	devFrame struct {
+		Frame
+		Source []sourceLine
+	}
+	devHeader struct {
+		Name, Value string
+	}
+	sourceLine struct {
+		Number  int
+		Code    string
+		Current bool
+	}
+)
+
+var devTemplate = htmltemplate.Must(htmltemplate.New("dev").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Report.Status}} {{.Report.Err}}</title>
+<style>
+body { font: 14px/1.4 sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; color: #b00; white-space: pre-wrap; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+code, pre { font: 13px/1.4 monospace; }
+.frame { margin: 1em 0; }
+.frame pre { background: #f6f6f6; padding: .5em; margin: .3em 0; overflow-x: auto; }
+.frame .cur { background: #fdd; }
+.frame .ln { color: #999; }
+table { border-collapse: collapse; }
+td { padding: .1em 1em .1em 0; vertical-align: top; }
+td:first-child { font-weight: bold; white-space: nowrap; }
+</style></head>
+<body>
+<h1>{{.Report.Err}}</h1>
+<p>{{.Report.Request.Method}} <code>{{.Report.Request.URL}}</code>{{if .Report.RequestID}}
+&middot; Request ID <code>{{.Report.RequestID}}</code>{{end}}
+&middot; {{.Report.Time.Format "2006-01-02 15:04:05.000 MST"}}</p>
+
+<h2>Stack</h2>
+{{range .Frames}}<div class="frame">
+<code>{{.Function}}</code><br><small>{{.File}}:{{.Line}}</small>
+{{- if .Source}}
+<pre>{{range .Source}}<span{{if .Current}} class="cur"{{end}}><span class="ln">{{printf "%4d" .Number}}</span> {{.Code}}</span>
+{{end}}</pre>{{end}}
+</div>{{end}}
+
+<h2>Request headers</h2>
+<table>{{range .Headers}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+
+<details><summary>Goroutine dump</summary>
+<pre>{{.Goroutines}}</pre>
+</details>
+</body></html>
+`))
+
+// writeDevPage writes the developer error page, with the source code around
+// each frame.
+func writeDevPage(w io.Writer, rep Report) error {
+	page := devPage{
+		Report:     rep,
+		Goroutines: string(allGoroutines()),
+	}
+
+	for _, f := range rep.Stack {
+		page.Frames = append(page.Frames, devFrame{
+			Frame:  f,
+			Source: readSource(f.File, f.Line, sourceContext),
+		})
+	}
+
+	for k, v := range rep.Request.Header {
+		for _, vv := range v {
+			page.Headers = append(page.Headers, devHeader{k, vv})
+		}
+	}
+	sort.SliceStable(page.Headers, func(i, j int) bool {
+		return page.Headers[i].Name < page.Headers[j].Name
+	})
+
+	return devTemplate.Execute(w, page)
+}
+
+// readSource reads the lines around line from file; it returns nil if the file
+// can't be read.
+func readSource(file string, line, context int) []sourceLine {
+	if file == "" || line <= 0 {
+		return nil
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer fp.Close() // nolint: errcheck
+
+	var (
+		lines   []sourceLine
+		scanner = bufio.NewScanner(fp)
+	)
+	for n := 1; scanner.Scan() && n <= line+context; n++ {
+		if n >= line-context {
+			lines = append(lines, sourceLine{
+				Number:  n,
+				Code:    scanner.Text(),
+				Current: n == line,
+			})
+		}
+	}
+	return lines
+}
+
+// allGoroutines gets the stack of all goroutines, growing the buffer until it
+// fits.
+func allGoroutines() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 16<<20 {
+			return buf[:n]
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
@@ -0,0 +1,100 @@
+package rescue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// Go runs fn in a new goroutine, recovering from any panic.
+//
+// Panics are logged with the Config of the Rescue middleware which handled r,
+// and the report includes the details of r.
+func Go(r *http.Request, fn func()) {
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				recoverBackground(r, rec)
+			}
+		}()
+		fn()
+	}()
+}
+
+// PanicError is returned by Group.Wait if a goroutine panicked.
+type PanicError struct {
+	Report Report
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Report.Err)
+}
+
+// Unwrap returns the panic value as an error.
+func (e *PanicError) Unwrap() error { return e.Report.Err }
+
+// Group runs goroutines for a request, recovering from panics; it's like
+// errgroup.Group but panics are logged and returned as a *PanicError.
+//
+// Use NewGroup to create a Group; the zero value isn't usable.
+type Group struct {
+	r      *http.Request
+	cancel func()
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+}
+
+// NewGroup creates a new Group for the request r.
+//
+// The returned context is derived from the request context and is canceled
+// when a goroutine returns an error or panics, or when Wait returns.
+func NewGroup(r *http.Request) (*Group, context.Context) {
+	ctx, cancel := context.WithCancel(r.Context())
+	return &Group{r: r, cancel: cancel}, ctx
+}
+
+// Go runs fn in a new goroutine.
+func (g *Group) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		var err error
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = &PanicError{Report: recoverBackground(g.r, rec)}
+			}
+			if err != nil {
+				g.once.Do(func() {
+					g.err = err
+					g.cancel()
+				})
+			}
+		}()
+
+		err = fn()
+	}()
+}
+
+// Wait for all goroutines to finish, returning the first error.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+// recoverBackground logs a panic recovered from a goroutine started by a
+// handler, with the same rules as the middleware.
+func recoverBackground(r *http.Request, rec interface{}) Report {
+	config := configFrom(r)
+	err := panicError(rec)
+
+	rep := newReport(r, rec, err, debug.Stack(), *config)
+	rep.Kind, rep.Status = classify(r, err)
+	rep.Background = true
+	config.logKind(r, rep)
+	return rep
+}
@@ -0,0 +1,163 @@
+package rescue
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report is a structured description of a recovered panic.
+type Report struct {
+	// Err is the panic value as an error.
+	Err error
+
+	// Value is the value passed to panic().
+	Value interface{}
+
+	// Stack is the panicking goroutine's stack, starting at the frame that
+	// called panic().
+	Stack []Frame
+
+	// RawStack is the full output of debug.Stack().
+	RawStack []byte
+
+	// Kind of panic, and the HTTP status code sent to the client.
+	Kind   Kind
+	Status int
+
+	// Request details, with sensitive headers filtered.
+	Request Request
+
+	// Background indicates the panic happened in a goroutine started with Go
+	// or Group, rather than in the handler.
+	Background bool
+
+	// ResponseStarted indicates the handler already sent (part of) the
+	// response before panicking, in which case the connection was aborted.
+	ResponseStarted bool
+
+	// RequestID is the ID of the request, if any.
+	RequestID string
+
+	// Time the panic was recovered.
+	Time time.Time
+
+	// Fingerprint groups panics with the same location and message. This and
+	// the other fields below are only set if Config.Tracker is set.
+	Fingerprint string
+
+	// FingerprintTotal is the number of panics with this fingerprint.
+	FingerprintTotal int64
+
+	// Suppressed is the number of panics with this fingerprint which weren't
+	// logged since the last one that was.
+	Suppressed int
+}
+
+// Frame is a single stack frame.
+type Frame struct {
+	Function string // e.g. "github.com/teamwork/foo.(*Bar).Baz"
+	File     string // e.g. "/src/foo/bar.go"
+	Line     int
+}
+
+// Request details in a Report.
+type Request struct {
+	Method string
+	URL    string
+	Header http.Header
+}
+
+// DefaultFilterHeaders are the headers which are filtered from reports if
+// Config.FilterHeaders is nil.
+var DefaultFilterHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Csrf-Token",
+	"X-Api-Key",
+}
+
+// newReport creates a new report for the recovered value rec.
+func newReport(r *http.Request, rec interface{}, err error, stack []byte, config Config) Report {
+	rep := Report{
+		Err:      err,
+		Value:    rec,
+		Stack:    parseStack(stack),
+		RawStack: stack,
+		Request: Request{
+			Method: r.Method,
+			Header: filterHeader(r.Header, config.FilterHeaders),
+		},
+		Time: time.Now(),
+	}
+	if r.URL != nil {
+		rep.Request.URL = r.URL.String()
+	}
+	if config.RequestID != nil {
+		rep.RequestID = config.RequestID(r)
+	}
+	return rep
+}
+
+// filterHeader returns a copy of h with the values of the headers in filter
+// replaced with "[FILTERED]".
+func filterHeader(h http.Header, filter []string) http.Header {
+	out := h.Clone()
+	for _, f := range filter {
+		if _, ok := out[http.CanonicalHeaderKey(f)]; ok {
+			out.Set(f, "[FILTERED]")
+		}
+	}
+	return out
+}
+
+// parseStack parses the output of debug.Stack() for the current goroutine.
+//
+// Everything up to and including the runtime's panic() frame is removed, so
+// the first frame is the one that panicked.
+func parseStack(stack []byte) []Frame {
+	var (
+		frames []Frame
+		lines  = bytes.Split(stack, []byte("\n"))
+	)
+
+	// First line is the "goroutine 1 [running]:" header; after that it's
+	// function and file:line pairs.
+	for i := 1; i+1 < len(lines); i += 2 {
+		fun := string(lines[i])
+		loc := strings.TrimSpace(string(lines[i+1]))
+		if fun == "" {
+			break
+		}
+
+		// Strip the argument list: "main.foo(0x1, 0x2)" -> "main.foo".
+		if j := strings.LastIndexByte(fun, '('); j > 0 && strings.HasSuffix(fun, ")") {
+			fun = fun[:j]
+		}
+		fun = strings.TrimPrefix(fun, "created by ")
+		if j := strings.Index(fun, " in goroutine "); j > 0 {
+			fun = fun[:j]
+		}
+
+		// Strip the PC offset: "/foo.go:12 +0x1d" -> "/foo.go:12".
+		if j := strings.LastIndexByte(loc, ' '); j > 0 {
+			loc = loc[:j]
+		}
+		f := Frame{Function: fun, File: loc}
+		if j := strings.LastIndexByte(loc, ':'); j > 0 {
+			f.File = loc[:j]
+			f.Line, _ = strconv.Atoi(loc[j+1:])
+		}
+
+		if fun == "panic" {
+			frames = frames[:0]
+			continue
+		}
+		frames = append(frames, f)
+	}
+
+	return frames
+}
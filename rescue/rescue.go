@@ -2,18 +2,56 @@
 //
 // It will also return an appropriate response to the client (HTML, JSON, or
 // text).
+//
+// Panics in goroutines started by a handler can't be recovered by the
+// middleware; use Go or Group to run them.
 package rescue // import "github.com/teamwork/middleware/rescue"
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"net/http"
 	"os"
 	"runtime/debug"
-
-	"github.com/kr/pretty"
+	texttemplate "text/template"
 )
 
+// Config for WithConfig.
+type Config struct {
+	// Log the panic report; defaults to printing the error to stderr.
+	Log func(*http.Request, Report)
+
+	// Dev shows the panic and stack trace in the response.
+	Dev bool
+
+	// Message to show to users; defaults to DefaultMessage.
+	Message string
+
+	// HTMLTemplate and TextTemplate render the HTML and text responses; they
+	// are executed with an ErrorPage. Defaults to DefaultHTMLTemplate and
+	// DefaultTextTemplate.
+	HTMLTemplate *htmltemplate.Template
+	TextTemplate *texttemplate.Template
+
+	// FilterHeaders are request headers which are replaced with "[FILTERED]"
+	// in the report. Defaults to DefaultFilterHeaders if nil.
+	FilterHeaders []string
+
+	// LogDisconnects logs panics caused by the client going away; these are
+	// usually not actionable.
+	LogDisconnects bool
+
+	// Tracker deduplicates logs of panics with the same fingerprint and
+	// alerts on high panic rates; all panics are logged if nil.
+	Tracker *Tracker
+
+	// RequestID gets the request ID for the report; defaults to the
+	// X-Request-Id header.
+	RequestID func(*http.Request) string
+}
+
 // Rescue from panic()s in any of the lower middleware or HTTP handlers.
 //
 // The extraFields callback can be used to add extra fields to the log (such as
@@ -29,8 +67,20 @@ func Rescue(
 		}
 	}
 
+	return WithConfig(Config{
+		Log: func(r *http.Request, rep Report) { log(r, rep.Err) },
+		Dev: dev,
+	})
+}
+
+// WithConfig returns a Rescue middleware from config; the log callback gets a
+// full Report of the panic.
+func WithConfig(config Config) func(http.Handler) http.Handler {
+	config = withDefaults(config)
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := &responseWriter{ResponseWriter: w}
 
 			defer func() {
 				rec := recover()
@@ -38,47 +88,112 @@ func Rescue(
 					return
 				}
 
-				var err error
-				switch rec := rec.(type) {
-				case error:
-					err = rec
-				case map[string]interface{}:
-					err, _ = rec["error"].(error)
-				default:
-					err = pretty.Errorf("%v", rec)
+				err := panicError(rec)
+				kind, status := classify(r, err)
+				if kind == KindAbort {
+					panic(rec)
 				}
 
-				log(r, err)
+				stack := debug.Stack()
+				rep := newReport(r, rec, err, stack, config)
+				rep.Kind = kind
+				rep.Status = status
+				rep.ResponseStarted = rw.wroteHeader || rw.hijacked
 
-				w.WriteHeader(http.StatusInternalServerError)
+				config.logKind(r, rep)
 
 				switch {
-				// Show panic in browser on dev.
-				case dev:
-					if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
-						w.Write([]byte(err.Error())) // nolint: errcheck
-						return
-					}
+				// The connection is no longer ours, so there's nothing we can
+				// send.
+				case rw.hijacked:
+					return
 
-					// nolint: errcheck
-					w.Write([]byte(fmt.Sprintf("<h2>%v</h2><pre>%s</pre>",
-						err, debug.Stack())))
-
-				// JSON response for AJAX.
-				case r.Header.Get("X-Requested-With") == "XMLHttpRequest":
-					b, _ := json.Marshal(map[string]interface{}{
-						"message": "Sorry, the server ran into a problem processing this request.",
-					})
-					w.Header().Add("Content-Type", "application/json")
-					w.Write(b) // nolint: errcheck
-
-				// Fall back to text.
-				default:
-					w.Write([]byte("Sorry, the server ran into a problem processing this request.")) // nolint: errcheck
+				// Part of the response was already sent; appending an error
+				// page would corrupt it, so abort the connection to let the
+				// client know the response is incomplete.
+				case rw.wroteHeader:
+					panic(http.ErrAbortHandler)
+
+				// Client is gone.
+				case kind == KindDisconnect:
+					return
+				}
+
+				message := config.Message
+				if kind == KindHTTPError {
+					message = http.StatusText(status)
+					var e *Error
+					if errors.As(err, &e) && e.Message != "" {
+						message = e.Message
+					}
 				}
+				writeError(w, r, config, status, message, rep)
 			}()
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(rw, r.WithContext(
+				context.WithValue(r.Context(), configKey{}, &config)))
 		})
 	}
 }
+
+type configKey struct{}
+
+// configFrom gets the Config of the Rescue middleware which handled r, or the
+// default Config if there is none.
+func configFrom(r *http.Request) *Config {
+	if c, ok := r.Context().Value(configKey{}).(*Config); ok {
+		return c
+	}
+	c := withDefaults(Config{})
+	return &c
+}
+
+// withDefaults sets the defaults for all empty fields in config.
+func withDefaults(config Config) Config {
+	if config.Log == nil {
+		config.Log = func(r *http.Request, rep Report) {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: %v\n", r.URL.Path, rep.Err)
+		}
+	}
+	if config.Message == "" {
+		config.Message = DefaultMessage
+	}
+	if config.HTMLTemplate == nil {
+		config.HTMLTemplate = DefaultHTMLTemplate
+	}
+	if config.TextTemplate == nil {
+		config.TextTemplate = DefaultTextTemplate
+	}
+	if config.FilterHeaders == nil {
+		config.FilterHeaders = DefaultFilterHeaders
+	}
+	if config.RequestID == nil {
+		config.RequestID = func(r *http.Request) string {
+			return r.Header.Get("X-Request-Id")
+		}
+	}
+	return config
+}
+
+// logKind logs the report if its Kind should be logged: aborts and 4xx HTTP
+// errors are never logged, and disconnects only with LogDisconnects.
+func (config *Config) logKind(r *http.Request, rep Report) {
+	switch {
+	case rep.Kind == KindAbort:
+	case rep.Kind == KindDisconnect:
+		if config.LogDisconnects {
+			config.log(r, rep)
+		}
+	case rep.Kind == KindHTTPError && rep.Status < 500:
+	default:
+		config.log(r, rep)
+	}
+}
+
+// log the report, unless the tracker says it's a duplicate.
+func (config *Config) log(r *http.Request, rep Report) {
+	if config.Tracker != nil && !config.Tracker.track(&rep) {
+		return
+	}
+	config.Log(r, rep)
+}
@@ -1,8 +1,19 @@
 package rescue
 
 import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/teamwork/test"
 )
@@ -44,3 +55,530 @@ func TestRescuePanic(t *testing.T) {
 		t.Errorf("body wrong:\nwant: %#v\ngot:  %#v\n", want, b)
 	}
 }
+
+type panicHeaders struct{}
+
+func (h panicHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Length", "4")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("ETag", `"x"`)
+	w.Header().Set("X-Request-Id", "42")
+	panic("oh noes!")
+}
+
+func TestRescuePanicHeaders(t *testing.T) {
+	srv := httptest.NewServer(Rescue(nil, false)(panicHeaders{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Sorry, the server ran into a problem processing this request."
+	if resp.StatusCode != 500 || string(b) != want {
+		t.Errorf("wrong response: %d %q", resp.StatusCode, b)
+	}
+	for k, want := range map[string]string{
+		"Content-Encoding": "",
+		"Cache-Control":    "no-store",
+		"Etag":             "",
+		"X-Request-Id":     "42",
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Errorf("header %s wrong\nout:  %#v\nwant: %#v", k, got, want)
+		}
+	}
+	if resp.ContentLength != int64(len(want)) {
+		t.Errorf("wrong Content-Length: %d", resp.ContentLength)
+	}
+}
+
+func TestWithConfigReport(t *testing.T) {
+	var rep Report
+	req, err := http.NewRequest("GET", "/foo?x=1", nil)
+	if err != nil {
+		t.Fatalf("cannot make request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept-Language", "en")
+	req.Header.Set("X-Request-Id", "req-1")
+
+	rr := test.HTTP(t, req, WithConfig(Config{
+		Log: func(_ *http.Request, got Report) { rep = got },
+	})(panicy{}))
+	if rr.Code != 500 {
+		t.Errorf("want code %v, got %v", 500, rr.Code)
+	}
+
+	if rep.Err == nil || rep.Err.Error() != "oh noes!" {
+		t.Errorf("wrong error: %v", rep.Err)
+	}
+	if rep.Value != "oh noes!" {
+		t.Errorf("wrong value: %#v", rep.Value)
+	}
+	if rep.RequestID != "req-1" {
+		t.Errorf("wrong request ID: %#v", rep.RequestID)
+	}
+	if rep.Request.Method != "GET" || rep.Request.URL != "/foo?x=1" {
+		t.Errorf("wrong request: %#v", rep.Request)
+	}
+	if h := rep.Request.Header.Get("Authorization"); h != "[FILTERED]" {
+		t.Errorf("Authorization not filtered: %#v", h)
+	}
+	if h := rep.Request.Header.Get("Accept-Language"); h != "en" {
+		t.Errorf("Accept-Language filtered: %#v", h)
+	}
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		t.Error("request header was modified")
+	}
+
+	if len(rep.Stack) == 0 {
+		t.Fatal("no stack frames")
+	}
+	if f := rep.Stack[0]; f.Function != "github.com/teamwork/middleware/rescue.panicy.ServeHTTP" ||
+		!strings.HasSuffix(f.File, "rescue_test.go") || f.Line == 0 {
+		t.Errorf("wrong first frame: %#v", f)
+	}
+}
+
+func TestParseStack(t *testing.T) {
+	stack := []byte(`goroutine 7 [running]:
+runtime/debug.Stack()
+	/usr/local/go/src/runtime/debug/stack.go:26 +0x5e
+github.com/teamwork/middleware/rescue.TestX.func1()
+	/root/module/rescue/x_test.go:3 +0x18
+panic({0x8dc430?, 0x95ae80?})
+	/usr/local/go/src/runtime/panic.go:859 +0x125
+github.com/teamwork/middleware/rescue.(*T).Foo(0x17e5b1254488?, {0x1, 0x2})
+	/root/module/rescue/x_test.go:3 +0x45
+created by testing.(*T).Run in goroutine 1
+	/usr/local/go/src/testing/testing.go:2258 +0x4d4
+`)
+
+	want := []Frame{
+		{"github.com/teamwork/middleware/rescue.(*T).Foo", "/root/module/rescue/x_test.go", 3},
+		{"testing.(*T).Run", "/usr/local/go/src/testing/testing.go", 2258},
+	}
+	got := parseStack(stack)
+	if len(got) != len(want) {
+		t.Fatalf("wrong length\nwant: %#v\ngot:  %#v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("frame %d wrong\nwant: %#v\ngot:  %#v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestRescueNegotiate(t *testing.T) {
+	cases := []struct {
+		accept, xhr         string
+		wantCT, wantContain string
+	}{
+		{"", "", "text/plain; charset=utf-8", DefaultMessage},
+		{"*/*", "", "text/plain; charset=utf-8", DefaultMessage},
+		{"", "XMLHttpRequest", "application/json; charset=utf-8", `{"message":`},
+		{"application/json", "", "application/json; charset=utf-8", `{"message":`},
+		{"application/problem+json, application/json;q=0.5", "", "application/problem+json; charset=utf-8", `"status":500`},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "", "text/html; charset=utf-8", "<h1>Internal Server Error</h1>"},
+		{"text/*;q=0.5, application/json;q=0.1", "", "text/plain; charset=utf-8", DefaultMessage},
+		{"text/html;q=0, */*", "", "text/plain; charset=utf-8", DefaultMessage},
+		{"image/png", "", "text/plain; charset=utf-8", DefaultMessage},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.accept, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+			req.Header.Set("Accept", tc.accept)
+			req.Header.Set("X-Requested-With", tc.xhr)
+
+			rr := test.HTTP(t, req, WithConfig(Config{
+				Log: func(*http.Request, Report) {},
+			})(panicy{}))
+			if rr.Code != 500 {
+				t.Errorf("want code %v, got %v", 500, rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != tc.wantCT {
+				t.Errorf("wrong Content-Type\nwant: %#v\ngot:  %#v", tc.wantCT, ct)
+			}
+			if b := rr.Body.String(); !strings.Contains(b, tc.wantContain) {
+				t.Errorf("body doesn't contain %#v:\n%s", tc.wantContain, b)
+			}
+		})
+	}
+}
+
+func TestRescueMessage(t *testing.T) {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("cannot make request: %v", err)
+	}
+	req.Header.Set("Accept", "text/html")
+
+	rr := test.HTTP(t, req, WithConfig(Config{
+		Log:          func(*http.Request, Report) {},
+		Message:      "<Oops>",
+		HTMLTemplate: template.Must(template.New("").Parse(`<p>{{.Message}} ({{.Status}})</p>`)),
+	})(panicy{}))
+
+	want := "<p>&lt;Oops&gt; (500)</p>"
+	if b := rr.Body.String(); b != want {
+		t.Errorf("body wrong:\nwant: %#v\ngot:  %#v\n", want, b)
+	}
+}
+
+type partial struct{}
+
+func (h partial) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("partial"))
+	panic("oh noes!")
+}
+
+func TestRescuePartial(t *testing.T) {
+	var rep Report
+	h := WithConfig(Config{
+		Log: func(_ *http.Request, got Report) { rep = got },
+	})(partial{})
+
+	rr := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if rec := recover(); rec != http.ErrAbortHandler {
+				t.Errorf("want http.ErrAbortHandler, got %#v", rec)
+			}
+		}()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	if !rep.ResponseStarted {
+		t.Error("ResponseStarted is false")
+	}
+	if rr.Code != 200 {
+		t.Errorf("want code %v, got %v", 200, rr.Code)
+	}
+	if b := rr.Body.String(); b != "partial" {
+		t.Errorf("body wrong:\nwant: %#v\ngot:  %#v\n", "partial", b)
+	}
+}
+
+func TestRescuePartialServer(t *testing.T) {
+	srv := httptest.NewServer(WithConfig(Config{
+		Log: func(*http.Request, Report) {},
+	})(partial{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		return // Aborted before the headers were received.
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Error("reading the body of an aborted response succeeded")
+	}
+}
+
+// readerFrom records if ReadFrom was used.
+type readerFrom struct {
+	*httptest.ResponseRecorder
+	used bool
+}
+
+func (w *readerFrom) ReadFrom(src io.Reader) (int64, error) {
+	w.used = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestRescueReadFrom(t *testing.T) {
+	var rep Report
+	h := WithConfig(Config{
+		Log: func(_ *http.Request, got Report) { rep = got },
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Error("ResponseWriter doesn't implement io.ReaderFrom")
+		}
+		// strings.Reader implements io.WriterTo, which io.Copy prefers.
+		_, _ = io.Copy(w, io.LimitReader(strings.NewReader("partial"), 100))
+		panic("oh noes!")
+	}))
+
+	for _, withReadFrom := range []bool{true, false} {
+		rep = Report{}
+		rr := httptest.NewRecorder()
+		var w http.ResponseWriter = rr
+		rf := &readerFrom{ResponseRecorder: rr}
+		if withReadFrom {
+			w = rf
+		}
+		func() {
+			defer func() { _ = recover() }()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		}()
+
+		if !rep.ResponseStarted {
+			t.Errorf("%t: ResponseStarted is false", withReadFrom)
+		}
+		if rf.used != withReadFrom {
+			t.Errorf("%t: ReadFrom used is %t", withReadFrom, rf.used)
+		}
+		if b := rr.Body.String(); b != "partial" {
+			t.Errorf("%t: body wrong:\nwant: %#v\ngot:  %#v\n", withReadFrom, "partial", b)
+		}
+	}
+}
+
+type panicValue struct{ v interface{} }
+
+func (h panicValue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	panic(h.v)
+}
+
+func TestRescueClassify(t *testing.T) {
+	cases := []struct {
+		name     string
+		v        interface{}
+		wantCode int
+		wantBody string
+		wantLog  bool
+		wantKind Kind
+	}{
+		{"panic", "oh noes!", 500, DefaultMessage, true, KindPanic},
+		{"not found", NewError(404, "No such project."), 404, "No such project.", false, KindHTTPError},
+		{"no message", &Error{Status: 403}, 403, "Forbidden", false, KindHTTPError},
+		{"wrapped", fmt.Errorf("wrap: %w", NewError(409, "Conflict!")), 409, "Conflict!", false, KindHTTPError},
+		{"5xx", &Error{Status: 503, Message: "Down", Err: errors.New("db")}, 503, "Down", true, KindHTTPError},
+		{"disconnect", syscall.EPIPE, 200, "", false, KindDisconnect},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				logged bool
+				rep    Report
+			)
+			h := WithConfig(Config{
+				Log: func(_ *http.Request, got Report) { logged, rep = true, got },
+			})(panicValue{tc.v})
+			rr := test.HTTP(t, nil, h)
+
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %v, got %v", tc.wantCode, rr.Code)
+			}
+			if b := rr.Body.String(); b != tc.wantBody {
+				t.Errorf("body wrong:\nwant: %#v\ngot:  %#v\n", tc.wantBody, b)
+			}
+			if logged != tc.wantLog {
+				t.Errorf("want logged %v, got %v", tc.wantLog, logged)
+			}
+			if logged && rep.Kind != tc.wantKind {
+				t.Errorf("want kind %v, got %v", tc.wantKind, rep.Kind)
+			}
+		})
+	}
+}
+
+func TestRescueAbort(t *testing.T) {
+	logged := false
+	h := WithConfig(Config{
+		Log: func(*http.Request, Report) { logged = true },
+	})(panicValue{http.ErrAbortHandler})
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("want http.ErrAbortHandler, got %#v", rec)
+		}
+		if logged {
+			t.Error("abort was logged")
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestRescueDevPage(t *testing.T) {
+	req, err := http.NewRequest("GET", "/foo", nil)
+	if err != nil {
+		t.Fatalf("cannot make request: %v", err)
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("X-Custom", "<b>hdr</b>")
+
+	rr := test.HTTP(t, req, WithConfig(Config{
+		Log: func(*http.Request, Report) {},
+		Dev: true,
+	})(panicValue{"<script>alert(1)</script>"}))
+
+	b := rr.Body.String()
+	for _, want := range []string{
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+		"&lt;b&gt;hdr&lt;/b&gt;",
+		"rescue.panicValue.ServeHTTP",
+		`class="cur"`,
+		"panic(h.v)",
+		"<summary>Goroutine dump</summary>",
+	} {
+		if !strings.Contains(b, want) {
+			t.Errorf("body doesn't contain %#v", want)
+		}
+	}
+	if strings.Contains(b, "<script>") || strings.Contains(b, "<b>hdr") {
+		t.Errorf("body contains unescaped HTML:\n%s", b)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	var alerts []Alert
+	tr := NewTracker(TrackerOptions{
+		Window:         time.Minute,
+		LogFirst:       2,
+		SampleEvery:    3,
+		AlertThreshold: 4,
+		Alert:          func(a Alert) { alerts = append(alerts, a) },
+	})
+
+	var logged []Report
+	h := WithConfig(Config{
+		Log:     func(_ *http.Request, rep Report) { logged = append(logged, rep) },
+		Tracker: tr,
+	})
+
+	for i := 0; i < 8; i++ {
+		// Different numbers in the message give the same fingerprint.
+		test.HTTP(t, nil, h(panicValue{fmt.Sprintf("index %d out of range", i)}))
+	}
+
+	// 2 first, then every 3rd: 1, 2, 5, 8
+	if len(logged) != 4 {
+		t.Fatalf("want 4 logs, got %d", len(logged))
+	}
+	if logged[2].Suppressed != 2 || logged[2].FingerprintTotal != 5 {
+		t.Errorf("wrong counters: %d suppressed, %d total", logged[2].Suppressed, logged[2].FingerprintTotal)
+	}
+	if len(alerts) != 1 || alerts[0].Count != 5 {
+		t.Errorf("wrong alerts: %#v", alerts)
+	}
+
+	// New window.
+	now = func() time.Time { return start.Add(time.Minute) }
+	test.HTTP(t, nil, h(panicValue{"index 1 out of range"}))
+	if len(logged) != 5 {
+		t.Errorf("want 5 logs, got %d", len(logged))
+	}
+
+	// Different message is a different fingerprint.
+	test.HTTP(t, nil, h(panicValue{"oh noes!"}))
+	if len(logged) != 6 || logged[5].Fingerprint == logged[0].Fingerprint {
+		t.Errorf("want new fingerprint logged")
+	}
+
+	stats := tr.Stats()
+	if len(stats) != 2 || stats[0].Total != 9 || stats[0].InWindow != 1 ||
+		stats[0].Message != "index N out of range" {
+		t.Errorf("wrong stats: %#v", stats)
+	}
+}
+
+func TestGo(t *testing.T) {
+	logged := make(chan Report, 1)
+	h := WithConfig(Config{
+		Log: func(_ *http.Request, rep Report) { logged <- rep },
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Go(r, func() { panic("background") })
+	}))
+
+	req, err := http.NewRequest("GET", "/bg", nil)
+	if err != nil {
+		t.Fatalf("cannot make request: %v", err)
+	}
+	rr := test.HTTP(t, req, h)
+	if rr.Code != 200 {
+		t.Errorf("want code %v, got %v", 200, rr.Code)
+	}
+
+	select {
+	case rep := <-logged:
+		if !rep.Background || rep.Err.Error() != "background" || rep.Request.URL != "/bg" {
+			t.Errorf("wrong report: %#v", rep)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic was not logged")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var logged []Report
+	h := WithConfig(Config{
+		Log: func(_ *http.Request, rep Report) { logged = append(logged, rep) },
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g, ctx := NewGroup(r)
+		g.Go(func() error { panic("oh noes!") })
+		g.Go(func() error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		err := g.Wait()
+		var pErr *PanicError
+		if !errors.As(err, &pErr) {
+			t.Fatalf("want *PanicError, got %#v", err)
+		}
+		if pErr.Error() != "panic: oh noes!" {
+			t.Errorf("wrong error: %v", pErr)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	rr := test.HTTP(t, nil, h)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("want code %v, got %v", http.StatusAccepted, rr.Code)
+	}
+	if len(logged) != 1 || !logged[0].Background {
+		t.Errorf("wrong logs: %#v", logged)
+	}
+}
+
+func TestGroupKinds(t *testing.T) {
+	for _, logDisconnects := range []bool{false, true} {
+		var (
+			mu     sync.Mutex
+			logged []Kind
+		)
+		h := WithConfig(Config{
+			LogDisconnects: logDisconnects,
+			Log: func(_ *http.Request, rep Report) {
+				mu.Lock()
+				defer mu.Unlock()
+				logged = append(logged, rep.Kind)
+			},
+		})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			g, _ := NewGroup(r)
+			g.Go(func() error { panic(http.ErrAbortHandler) })
+			g.Go(func() error { panic(syscall.EPIPE) })
+			g.Go(func() error { panic(&Error{Status: 404}) })
+			g.Go(func() error { panic("oh noes!") })
+			_ = g.Wait()
+		}))
+		test.HTTP(t, nil, h)
+
+		want := []Kind{KindPanic}
+		if logDisconnects {
+			want = []Kind{KindPanic, KindDisconnect}
+		}
+		sort.Slice(logged, func(i, j int) bool { return logged[i] < logged[j] })
+		if fmt.Sprint(logged) != fmt.Sprint(want) {
+			t.Errorf("LogDisconnects %t\nout:  %v\nwant: %v", logDisconnects, logged, want)
+		}
+	}
+}
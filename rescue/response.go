@@ -0,0 +1,186 @@
+package rescue
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Content types we can respond with.
+const (
+	ContentTypeText    = "text/plain"
+	ContentTypeHTML    = "text/html"
+	ContentTypeJSON    = "application/json"
+	ContentTypeProblem = "application/problem+json"
+)
+
+// offers in order of preference for ties; text is first as that's what we
+// always sent before content negotiation was added.
+var offers = []string{ContentTypeText, ContentTypeJSON, ContentTypeProblem, ContentTypeHTML}
+
+// DefaultMessage is the message shown to users if Config.Message is empty.
+const DefaultMessage = "Sorry, the server ran into a problem processing this request."
+
+// DefaultHTMLTemplate is used for HTML responses if Config.HTMLTemplate is nil.
+var DefaultHTMLTemplate = htmltemplate.Must(htmltemplate.New("error").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body><h1>{{.Title}}</h1><p>{{.Message}}</p>{{if .RequestID}}
+<p><small>Request ID: {{.RequestID}}</small></p>{{end}}</body></html>
+`))
+
+// DefaultTextTemplate is used for text responses if Config.TextTemplate is
+// nil.
+var DefaultTextTemplate = texttemplate.Must(texttemplate.New("error").Parse(`{{.Message}}`))
+
+// ErrorPage is passed to the HTML and text templates.
+type ErrorPage struct {
+	Status    int    // HTTP status code, e.g. 500.
+	Title     string // Status text, e.g. "Internal Server Error".
+	Message   string // Message for the user.
+	RequestID string
+}
+
+// Problem is an RFC 7807 problem details object.
+//
+// See: https://tools.ietf.org/html/rfc7807
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// negotiate picks the best content type from the Accept header.
+//
+// Old-style AJAX requests which send X-Requested-With but no specific Accept
+// header get JSON.
+func negotiate(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" &&
+		(accept == "" || accept == "*/*") {
+		return ContentTypeJSON
+	}
+	if accept == "" {
+		return ContentTypeText
+	}
+
+	best, bestQ := ContentTypeText, 0.0
+	for _, o := range offers {
+		if q := quality(accept, o); q > bestQ {
+			best, bestQ = o, q
+		}
+	}
+	return best
+}
+
+// quality gets the q-value for the content type ct from the Accept header,
+// using the most specific matching media range.
+func quality(accept, ct string) float64 {
+	var (
+		q           = 0.0
+		specificity = -1
+	)
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		var s int
+		switch {
+		case mt == ct:
+			s = 2
+		case mt == "*/*":
+			s = 0
+		case strings.HasSuffix(mt, "/*") && strings.HasPrefix(ct, strings.TrimSuffix(mt, "*")):
+			s = 1
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+
+		specificity = s
+		q = 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				q = 0
+			}
+		}
+	}
+	return q
+}
+
+// resetHeaders are removed before writing an error response.
+var resetHeaders = []string{
+	"Content-Length", "Content-Encoding", "Content-Disposition", "Content-Range",
+	"ETag", "Last-Modified", "Cache-Control", "Expires",
+}
+
+// writeError writes the error response for status with message, based on the
+// Accept header.
+func writeError(w http.ResponseWriter, r *http.Request, config Config, status int, message string, rep Report) {
+	page := ErrorPage{
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   message,
+		RequestID: rep.RequestID,
+	}
+	if config.Dev {
+		page.Message = rep.Err.Error()
+	}
+
+	// Headers the handler set describe the response it didn't finish; the
+	// error shouldn't be cached either.
+	h := w.Header()
+	for _, k := range resetHeaders {
+		h.Del(k)
+	}
+	h.Set("Cache-Control", "no-store")
+
+	ct := negotiate(r)
+	w.Header().Set("Content-Type", ct+"; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	switch ct {
+	case ContentTypeJSON:
+		b, _ := json.Marshal(map[string]interface{}{
+			"message": page.Message,
+		})
+		w.Write(b) // nolint: errcheck
+
+	case ContentTypeProblem:
+		b, _ := json.Marshal(Problem{
+			Type:     "about:blank",
+			Title:    page.Title,
+			Status:   status,
+			Detail:   page.Message,
+			Instance: r.URL.Path,
+		})
+		w.Write(b) // nolint: errcheck
+
+	case ContentTypeHTML:
+		// Show panic in browser on dev.
+		if config.Dev {
+			_ = writeDevPage(w, rep)
+			return
+		}
+		_ = config.HTMLTemplate.Execute(w, page)
+
+	default:
+		if config.Dev {
+			_, _ = fmt.Fprintf(w, "%v\n\n%s", rep.Err, rep.RawStack)
+			return
+		}
+		_ = config.TextTemplate.Execute(w, page)
+	}
+}
@@ -0,0 +1,213 @@
+package rescue
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Helper function to make it easier to test.
+var now = func() time.Time { return time.Now() }
+
+// TrackerOptions for NewTracker.
+type TrackerOptions struct {
+	// Window is the period over which panics are counted for sampling and
+	// alerting; defaults to a minute.
+	Window time.Duration
+
+	// LogFirst is the number of panics with the same fingerprint which are
+	// logged in each window; defaults to 1.
+	LogFirst int
+
+	// SampleEvery logs every Nth panic after the first LogFirst panics in a
+	// window. If 0 no further panics are logged until the next window.
+	SampleEvery int
+
+	// AlertThreshold is the number of panics with the same fingerprint in a
+	// window after which Alert is called. Alerts are disabled if 0.
+	AlertThreshold int
+
+	// Alert is called once per window when a fingerprint exceeds
+	// AlertThreshold.
+	Alert func(Alert)
+
+	// MaxFingerprints is the maximum number of fingerprints to keep track
+	// of; the least recently seen is removed when it's exceeded. Defaults to
+	// 1000.
+	MaxFingerprints int
+}
+
+// Alert is passed to TrackerOptions.Alert.
+type Alert struct {
+	Fingerprint string
+	Count       int           // Number of panics in the window.
+	Window      time.Duration // Window the panics were counted in.
+	Report      Report        // Report of the panic which triggered the alert.
+}
+
+// FingerprintStats are the counters for a single fingerprint.
+type FingerprintStats struct {
+	Fingerprint string
+	Site        string // Function and file:line of the panic.
+	Message     string // Normalized panic message.
+	Total       int64  // Number of panics since the tracker was created.
+	InWindow    int    // Number of panics in the current window.
+	FirstSeen   time.Time
+	LastSeen    time.Time
+}
+
+// Tracker groups panics by fingerprint to deduplicate logs and alert on high
+// panic rates.
+//
+// The fingerprint is based on the location of the panic and the panic message,
+// with numbers removed so that e.g. "index out of range [5]" and "index out of
+// range [6]" are grouped together.
+type Tracker struct {
+	opts TrackerOptions
+
+	mu    sync.Mutex
+	stats map[string]*trackerEntry
+}
+
+type trackerEntry struct {
+	FingerprintStats
+	windowStart time.Time
+	suppressed  int
+	alerted     bool
+}
+
+// NewTracker creates a new panic tracker.
+func NewTracker(opts TrackerOptions) *Tracker {
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	if opts.LogFirst <= 0 {
+		opts.LogFirst = 1
+	}
+	if opts.MaxFingerprints <= 0 {
+		opts.MaxFingerprints = 1000
+	}
+	return &Tracker{opts: opts, stats: make(map[string]*trackerEntry)}
+}
+
+// Stats gets the counters for all fingerprints, sorted by the total number of
+// panics (most first).
+func (t *Tracker) Stats() []FingerprintStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make([]FingerprintStats, 0, len(t.stats))
+	for _, e := range t.stats {
+		stats = append(stats, e.FingerprintStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total == stats[j].Total {
+			return stats[i].Fingerprint < stats[j].Fingerprint
+		}
+		return stats[i].Total > stats[j].Total
+	})
+	return stats
+}
+
+// track records the panic in rep, setting the fingerprint fields. It reports if
+// the panic should be logged.
+func (t *Tracker) track(rep *Report) bool {
+	site, msg := panicSite(rep.Stack), normalizeMessage(rep.Err)
+	h := sha1.Sum([]byte(site + "\x00" + msg))
+	rep.Fingerprint = hex.EncodeToString(h[:8])
+
+	var (
+		n     = now()
+		alert *Alert
+		log   bool
+	)
+
+	t.mu.Lock()
+	e, ok := t.stats[rep.Fingerprint]
+	if !ok {
+		if len(t.stats) >= t.opts.MaxFingerprints {
+			t.evict()
+		}
+		e = &trackerEntry{FingerprintStats: FingerprintStats{
+			Fingerprint: rep.Fingerprint,
+			Site:        site,
+			Message:     msg,
+			FirstSeen:   n,
+		}}
+		t.stats[rep.Fingerprint] = e
+	}
+
+	if n.Sub(e.windowStart) >= t.opts.Window {
+		e.windowStart = n
+		e.InWindow = 0
+		e.alerted = false
+	}
+	e.Total++
+	e.InWindow++
+	e.LastSeen = n
+
+	log = e.InWindow <= t.opts.LogFirst ||
+		(t.opts.SampleEvery > 0 && (e.InWindow-t.opts.LogFirst)%t.opts.SampleEvery == 0)
+	if log {
+		rep.Suppressed = e.suppressed
+		e.suppressed = 0
+	} else {
+		e.suppressed++
+	}
+	rep.FingerprintTotal = e.Total
+
+	if t.opts.Alert != nil && t.opts.AlertThreshold > 0 &&
+		e.InWindow > t.opts.AlertThreshold && !e.alerted {
+		e.alerted = true
+		alert = &Alert{
+			Fingerprint: rep.Fingerprint,
+			Count:       e.InWindow,
+			Window:      t.opts.Window,
+			Report:      *rep,
+		}
+	}
+	t.mu.Unlock()
+
+	if alert != nil {
+		t.opts.Alert(*alert)
+	}
+	return log
+}
+
+// evict the least recently seen fingerprint; must hold the lock.
+func (t *Tracker) evict() {
+	var oldest *trackerEntry
+	for _, e := range t.stats {
+		if oldest == nil || e.LastSeen.Before(oldest.LastSeen) {
+			oldest = e
+		}
+	}
+	if oldest != nil {
+		delete(t.stats, oldest.Fingerprint)
+	}
+}
+
+// panicSite gets the first non-runtime frame as "function file:line".
+func panicSite(stack []Frame) string {
+	for _, f := range stack {
+		if !strings.HasPrefix(f.Function, "runtime.") {
+			return fmt.Sprintf("%s %s:%d", f.Function, f.File, f.Line)
+		}
+	}
+	return ""
+}
+
+var reNumber = regexp.MustCompile(`(0x[0-9a-fA-F]+|[0-9]+)`)
+
+// normalizeMessage removes numbers from the error message.
+func normalizeMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return reNumber.ReplaceAllString(err.Error(), "N")
+}
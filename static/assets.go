@@ -0,0 +1,313 @@
+package static
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Asset is a fingerprinted file.
+type Asset struct {
+	// Name is the logical name, e.g. "js/app.js" (or "src/main.ts" for vite
+	// manifests).
+	Name string
+
+	// File is the fingerprinted file name, e.g. "js/app.3f2a9c1b.js".
+	File string
+
+	// Integrity is the Subresource Integrity hash, e.g. "sha384-...".
+	Integrity string
+
+	// CSS are the fingerprinted CSS files imported by the asset, from vite
+	// manifests.
+	CSS []string
+
+	// path is the actual file in the filesystem.
+	path string
+
+	// assets are other fingerprinted files imported by the asset, such as
+	// images, from vite manifests.
+	assets []string
+}
+
+// AssetsOptions for NewAssets.
+type AssetsOptions struct {
+	// Prefix is the URL path the handler is mounted on; defaults to
+	// "/assets/".
+	Prefix string
+
+	// Manifest is the path of a webpack or vite manifest in the filesystem,
+	// e.g. "manifest.json" or ".vite/manifest.json". If set the files are
+	// expected to be fingerprinted by the bundler already; if not, all files
+	// are hashed on startup.
+	Manifest string
+
+	// Options for serving the files; SPA is ignored.
+	Options Options
+}
+
+// Assets serves fingerprinted files, and resolves logical names to
+// fingerprinted URLs.
+type Assets struct {
+	prefix string
+	byName map[string]*Asset
+	byFile map[string]*Asset
+	files  http.Handler
+}
+
+// NewAssets creates an asset pipeline for fsys.
+//
+// Fingerprinted files are served with cache.PolicyImmutable; other files are
+// served with no-cache.
+//
+// Use FuncMap to get the URLs in templates:
+//
+//	<script src="{{asset "js/app.js"}}" integrity="{{assetIntegrity "js/app.js"}}"
+//	        crossorigin="anonymous"></script>
+func NewAssets(fsys fs.FS, opts AssetsOptions) (*Assets, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "/assets/"
+	}
+	if !strings.HasSuffix(opts.Prefix, "/") {
+		opts.Prefix += "/"
+	}
+	opts.Options.SPA = nil
+
+	a := &Assets{
+		prefix: opts.Prefix,
+		byName: make(map[string]*Asset),
+		byFile: make(map[string]*Asset),
+		files:  FileServerFS(fsys, opts.Options),
+	}
+
+	var (
+		assets []*Asset
+		err    error
+	)
+	if opts.Manifest != "" {
+		assets, err = readManifest(fsys, opts.Manifest, opts.Prefix)
+	} else {
+		assets, err = hashFiles(fsys)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, as := range assets {
+		if as.Integrity == "" {
+			if _, as.Integrity, err = hashFile(fsys, as.path); err != nil {
+				return nil, err
+			}
+		}
+		a.byName[as.Name] = as
+		a.byFile[as.File] = as
+	}
+
+	// Files imported by entries are fingerprinted too.
+	for _, as := range assets {
+		for _, files := range [][]string{as.CSS, as.assets} {
+			for _, f := range files {
+				if _, ok := a.byFile[f]; !ok {
+					a.byFile[f] = &Asset{Name: f, File: f, path: f}
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// Lookup gets the asset by logical name.
+func (a *Assets) Lookup(name string) (*Asset, bool) {
+	as, ok := a.byName[strings.TrimPrefix(name, "/")]
+	return as, ok
+}
+
+// URL gets the fingerprinted URL for the logical name.
+func (a *Assets) URL(name string) (string, error) {
+	as, ok := a.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("static: unknown asset %q", name)
+	}
+	return a.prefix + as.File, nil
+}
+
+// Integrity gets the Subresource Integrity hash for the logical name.
+func (a *Assets) Integrity(name string) (string, error) {
+	as, ok := a.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("static: unknown asset %q", name)
+	}
+	return as.Integrity, nil
+}
+
+// CSS gets the URLs of the CSS files imported by the logical name.
+func (a *Assets) CSS(name string) ([]string, error) {
+	as, ok := a.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("static: unknown asset %q", name)
+	}
+	urls := make([]string, len(as.CSS))
+	for i, c := range as.CSS {
+		urls[i] = a.prefix + c
+	}
+	return urls, nil
+}
+
+// FuncMap gets the template functions "asset", "assetIntegrity", and
+// "assetCSS" for html/template.
+func (a *Assets) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"asset":          a.URL,
+		"assetIntegrity": a.Integrity,
+		"assetCSS":       a.CSS,
+	}
+}
+
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, a.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, a.prefix)
+	if as, ok := a.byFile[name]; ok {
+		w.Header().Set("Cache-Control", immutable)
+		name = as.path
+	} else {
+		w.Header().Set("Cache-Control", noCache)
+	}
+
+	u := *r.URL
+	u.Path, u.RawPath = "/"+name, ""
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = &u
+	a.files.ServeHTTP(w, r2)
+}
+
+// hashFiles adds the content hash to the names of all files in fsys, except
+// dotfiles and precompressed siblings.
+func hashFiles(fsys fs.FS) ([]*Asset, error) {
+	var assets []*Asset
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || precompressedSibling(fsys, p) {
+			return nil
+		}
+
+		sum, integrity, err := hashFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		ext := path.Ext(p)
+		assets = append(assets, &Asset{
+			Name:      p,
+			File:      strings.TrimSuffix(p, ext) + "." + sum[:8] + ext,
+			Integrity: integrity,
+			path:      p,
+		})
+		return nil
+	})
+	return assets, err
+}
+
+// precompressedSibling reports if p is a precompressed version of another file.
+func precompressedSibling(fsys fs.FS, p string) bool {
+	for _, enc := range DefaultEncodings {
+		if strings.HasSuffix(p, enc.Ext) {
+			if _, err := fs.Stat(fsys, strings.TrimSuffix(p, enc.Ext)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hashFile gets the hex SHA-256 and the SRI SHA-384 hash of a file.
+func hashFile(fsys fs.FS, p string) (string, string, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return "", "", fmt.Errorf("static: %w", err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	h256, h384 := sha256.New(), sha512.New384()
+	if _, err := io.Copy(io.MultiWriter(h256, h384), f); err != nil {
+		return "", "", fmt.Errorf("static: reading %q: %w", p, err)
+	}
+	return hex.EncodeToString(h256.Sum(nil)),
+		"sha384-" + base64.StdEncoding.EncodeToString(h384.Sum(nil)), nil
+}
+
+// readManifest reads a webpack manifest ({"app.js": "app.3f2a9c1b.js"}) or a
+// vite manifest ({"src/main.ts": {"file": "assets/main-BqFkGx3a.js"}}).
+func readManifest(fsys fs.FS, name, prefix string) ([]*Asset, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("static: reading manifest: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("static: parsing manifest %q: %w", name, err)
+	}
+
+	// Webpack manifests may include the public path in the file names.
+	clean := func(file string) string {
+		file = strings.TrimPrefix(file, prefix)
+		return strings.TrimPrefix(file, "/")
+	}
+
+	names := make([]string, 0, len(raw))
+	for k := range raw {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	assets := make([]*Asset, 0, len(raw))
+	for _, k := range names {
+		var (
+			as   = &Asset{Name: strings.TrimPrefix(k, "/")}
+			file string
+			vite struct {
+				File   string   `json:"file"`
+				CSS    []string `json:"css"`
+				Assets []string `json:"assets"`
+			}
+		)
+		switch {
+		case json.Unmarshal(raw[k], &file) == nil:
+			as.File = clean(file)
+		case json.Unmarshal(raw[k], &vite) == nil && vite.File != "":
+			as.File = clean(vite.File)
+			for _, c := range vite.CSS {
+				as.CSS = append(as.CSS, clean(c))
+			}
+			for _, f := range vite.Assets {
+				as.assets = append(as.assets, clean(f))
+			}
+		default:
+			return nil, fmt.Errorf("static: manifest %q: unknown format for %q", name, k)
+		}
+		as.path = as.File
+		assets = append(assets, as)
+	}
+	return assets, nil
+}
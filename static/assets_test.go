@@ -0,0 +1,169 @@
+package static
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAssets(t *testing.T) {
+	js := []byte("var x = 1;")
+	sum := sha256.Sum256(js)
+	hash := hex.EncodeToString(sum[:])[:8]
+	sri := sha512.Sum384(js)
+	integrity := "sha384-" + base64.StdEncoding.EncodeToString(sri[:])
+
+	a, err := NewAssets(fstest.MapFS{
+		"js/app.js":     {Data: js},
+		"js/app.js.gz":  {Data: []byte("gzip")},
+		"js/app.js.map": {Data: []byte("{}")},
+		"LICENSE":       {Data: []byte("MIT")},
+		".env":          {Data: []byte("secret")},
+		".git/config":   {Data: []byte("secret")},
+	}, AssetsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := a.Lookup("js/app.js.gz"); ok {
+		t.Error("precompressed file has an asset")
+	}
+	if _, ok := a.Lookup(".env"); ok {
+		t.Error("dotfile has an asset")
+	}
+	if u, _ := a.URL("LICENSE"); !strings.HasPrefix(u, "/assets/LICENSE.") {
+		t.Errorf("wrong URL for file without extension: %s", u)
+	}
+
+	tpl := template.Must(template.New("").Funcs(a.FuncMap()).Parse(
+		`<script src="{{asset "js/app.js"}}" integrity="{{assetIntegrity "/js/app.js"}}"></script>`))
+	var b strings.Builder
+	if err := tpl.Execute(&b, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `<script src="/assets/js/app.` + hash + `.js" integrity="` + integrity + `"></script>`
+	if b.String() != want {
+		t.Errorf("template wrong\nout:  %s\nwant: %s", b.String(), want)
+	}
+
+	tpl = template.Must(template.New("").Funcs(a.FuncMap()).Parse(`{{asset "nonexistent.js"}}`))
+	if err := tpl.Execute(&b, nil); err == nil || !strings.Contains(err.Error(), `unknown asset "nonexistent.js"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	cases := []struct {
+		path, acceptEncoding string
+		wantCode             int
+		wantBody, wantCache  string
+	}{
+		{"/assets/js/app." + hash + ".js", "", 200, "var x = 1;", "public,max-age=31536000,immutable"},
+		{"/assets/js/app." + hash + ".js", "gzip", 200, "gzip", "public,max-age=31536000,immutable"},
+		{"/assets/js/app.js", "", 200, "var x = 1;", "no-cache"},
+		{"/assets/js/app.js.map", "", 200, "{}", "no-cache"},
+		{"/assets/js/app.00000000.js", "", 404, "404 page not found\n", "no-cache"},
+		{"/assets/.env", "", 404, "", "no-cache"},
+		{"/other/js/app.js", "", 404, "404 page not found\n", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path+" "+tc.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			rr := httptest.NewRecorder()
+			a.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %d, got %d", tc.wantCode, rr.Code)
+			}
+			if b := rr.Body.String(); b != tc.wantBody {
+				t.Errorf("body wrong\nout:  %#v\nwant: %#v", b, tc.wantBody)
+			}
+			if c := rr.Header().Get("Cache-Control"); c != tc.wantCache {
+				t.Errorf("Cache-Control wrong: %#v", c)
+			}
+			if tc.wantCode == 200 && strings.HasSuffix(tc.path, ".js") &&
+				rr.Header().Get("Content-Type") != "text/javascript; charset=utf-8" {
+				t.Errorf("Content-Type wrong: %#v", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestAssetsManifest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.3f2a9c1b.js":          {Data: []byte("webpack")},
+		"webpack.json":              {Data: []byte(`{"main.js": "/static/main.3f2a9c1b.js"}`)},
+		"assets/main-BqFkGx3a.js":   {Data: []byte("vite")},
+		"assets/main-C4x9Lk2b.css":  {Data: []byte("body {}")},
+		"assets/shared-D3k2Jx8a.js": {Data: []byte("shared")},
+		"assets/logo-Dk3x9Lq2.svg":  {Data: []byte("<svg></svg>")},
+		".vite/manifest.json": {Data: []byte(`{
+			"src/main.ts": {"file": "assets/main-BqFkGx3a.js", "isEntry": true, "css": ["assets/main-C4x9Lk2b.css"],
+				"assets": ["assets/logo-Dk3x9Lq2.svg"]},
+			"_shared.js": {"file": "assets/shared-D3k2Jx8a.js"}
+		}`)},
+		"broken.json":  {Data: []byte(`{"x": 1}`)},
+		"missing.json": {Data: []byte(`{"x.js": "x.12345678.js"}`)},
+	}
+
+	t.Run("webpack", func(t *testing.T) {
+		a, err := NewAssets(fsys, AssetsOptions{Prefix: "/static", Manifest: "webpack.json"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u, err := a.URL("main.js"); u != "/static/main.3f2a9c1b.js" || err != nil {
+			t.Errorf("wrong URL: %s %v", u, err)
+		}
+
+		rr := httptest.NewRecorder()
+		a.ServeHTTP(rr, httptest.NewRequest("GET", "/static/main.3f2a9c1b.js", nil))
+		if rr.Body.String() != "webpack" || rr.Header().Get("Cache-Control") != "public,max-age=31536000,immutable" {
+			t.Errorf("wrong response: %#v %v", rr.Body.String(), rr.Header())
+		}
+	})
+
+	t.Run("vite", func(t *testing.T) {
+		a, err := NewAssets(fsys, AssetsOptions{Manifest: ".vite/manifest.json"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tpl := template.Must(template.New("").Funcs(a.FuncMap()).Parse(
+			`{{range assetCSS "src/main.ts"}}<link href="{{.}}">{{end}}<script src="{{asset "src/main.ts"}}"></script>`))
+		var b strings.Builder
+		if err := tpl.Execute(&b, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := `<link href="/assets/assets/main-C4x9Lk2b.css"><script src="/assets/assets/main-BqFkGx3a.js"></script>`
+		if b.String() != want {
+			t.Errorf("template wrong\nout:  %s\nwant: %s", b.String(), want)
+		}
+		if as, _ := a.Lookup("_shared.js"); as == nil || !strings.HasPrefix(as.Integrity, "sha384-") {
+			t.Errorf("wrong asset: %#v", as)
+		}
+
+		for _, p := range []string{
+			"/assets/assets/main-BqFkGx3a.js",
+			"/assets/assets/main-C4x9Lk2b.css",
+			"/assets/assets/logo-Dk3x9Lq2.svg",
+		} {
+			rr := httptest.NewRecorder()
+			a.ServeHTTP(rr, httptest.NewRequest("GET", p, nil))
+			if rr.Code != 200 || rr.Header().Get("Cache-Control") != "public,max-age=31536000,immutable" {
+				t.Errorf("%s: wrong response: %d %v", p, rr.Code, rr.Header())
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, m := range []string{"broken.json", "missing.json", "nonexistent.json"} {
+			if _, err := NewAssets(fsys, AssetsOptions{Manifest: m}); err == nil {
+				t.Errorf("%s: no error", m)
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package static
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Canonicalize rejects request paths which are commonly used to get around path
+// checks with a 400 Bad Request, and normalises backslashes (including "%5c")
+// to slashes.
+//
+// Rejected are paths with:
+//
+//   - control characters, including NUL bytes ("%00");
+//   - invalid UTF-8, including overlong encodings ("%c0%ae" for ".");
+//   - percent-encoding left after decoding, from double encoding
+//     ("%252e%252e" decodes to "%2e%2e");
+//   - encoded slashes ("..%2f"), or a RawPath which doesn't match the Path.
+//
+// The guards in this package (BlockTraversal, BlockDotfiles, etc.) do the same
+// checks on the path internally, and FileServer and FileServerFS use
+// Canonicalize; it's only needed to protect other handlers.
+func Canonicalize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := canonicalPath(r.URL)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if p != r.URL.Path {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path, r2.URL.RawPath = p, ""
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canonicalPath gets the path to check for a request URL; it returns false if
+// the path should be rejected. The path is returned as-is if nothing needs to
+// change.
+func canonicalPath(u *url.URL) (string, bool) {
+	p := u.Path
+	if u.RawPath != "" {
+		if strings.Contains(strings.ToLower(u.RawPath), "%2f") {
+			return "", false
+		}
+		if dec, err := url.PathUnescape(u.RawPath); err != nil || dec != p {
+			return "", false
+		}
+	}
+
+	backslash := false
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case c < 0x20 || c == 0x7f:
+			return "", false
+		case c == '%' && i+2 < len(p) && isHex(p[i+1]) && isHex(p[i+2]):
+			return "", false
+		case c == '\\':
+			backslash = true
+		}
+	}
+	if !utf8.ValidString(p) {
+		return "", false
+	}
+
+	if backslash {
+		p = strings.ReplaceAll(p, `\`, "/")
+	}
+	return p, true
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
@@ -0,0 +1,140 @@
+package static
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCanonicalize(t *testing.T) {
+	cases := []struct {
+		target   string
+		wantCode int
+		wantPath string
+	}{
+		{"/some/path", 200, "/some/path"},
+		{"/some%20path", 200, "/some path"},
+		{"/100%25.txt", 200, "/100%.txt"},
+		{`/some\path`, 200, "/some/path"},
+		{"/some%5Cpath", 200, "/some/path"},
+		{"/..%2f..%2fetc/passwd", 400, ""},
+		{"/..%2F..%2Fetc/passwd", 400, ""},
+		{"/%252e%252e/%252e%252e/etc/passwd", 400, ""},
+		{"/%25%32%65", 400, ""},
+		{"/file.txt%00.png", 400, ""},
+		{"/file%0a", 400, ""},
+		{"/file%7f", 400, ""},
+		{"/%c0%ae%c0%ae/etc/passwd", 400, ""},
+		{"/%c0%af", 400, ""},
+		{"/%e0%80%ae", 400, ""},
+		{"/%ff", 400, ""},
+		{"/caf%c3%a9", 200, "/café"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.target, func(t *testing.T) {
+			var gotPath string
+			h := Canonicalize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			u, err := url.ParseRequestURI(tc.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.URL = u
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %d, got %d", tc.wantCode, rr.Code)
+			}
+			if gotPath != tc.wantPath {
+				t.Errorf("path wrong\nout:  %#v\nwant: %#v", gotPath, tc.wantPath)
+			}
+
+			// The guards should reject the same paths.
+			for name, g := range map[string]http.Handler{
+				"BlockTraversal":   BlockTraversal("/root")(handle{}),
+				"BlockTraversalFS": BlockTraversalFS(handle{}),
+				"BlockDotfiles":    BlockDotfiles(handle{}),
+			} {
+				rr := httptest.NewRecorder()
+				g.ServeHTTP(rr, req)
+				if (rr.Code == 400) != (tc.wantCode == 400) {
+					t.Errorf("%s: wrong code %d", name, rr.Code)
+				}
+			}
+		})
+	}
+}
+
+// FuzzFileServer checks that no request can read files outside of root, or
+// dotfiles.
+func FuzzFileServer(f *testing.F) {
+	for _, s := range []string{
+		"/ok.txt",
+		"/../secret.txt",
+		"/..%2f..%2fsecret.txt",
+		"/%2e%2e/secret.txt",
+		"/%252e%252e/secret.txt",
+		"/..%5csecret.txt",
+		`/..\secret.txt`,
+		"/ok.txt%00.png",
+		"/%c0%ae%c0%ae/secret.txt",
+		"/.hidden",
+		"/%2ehidden",
+		`/\.hidden`,
+		"/ok.txt/../.hidden",
+		"/..;/secret.txt",
+		"//secret.txt",
+		"/./.hidden",
+	} {
+		f.Add(s)
+	}
+
+	base := f.TempDir()
+	root := filepath.Join(base, "root")
+	for name, data := range map[string]string{
+		"root/ok.txt":  "ok",
+		"root/.hidden": "HIDDEN",
+		"secret.txt":   "SECRET",
+		"root-2/x.txt": "SECRET",
+	} {
+		p := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			f.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			f.Fatal(err)
+		}
+	}
+	h := FileServer(root, Options{})
+
+	f.Fuzz(func(t *testing.T, target string) {
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			return
+		}
+
+		if p, ok := canonicalPath(u); ok {
+			if !utf8.ValidString(p) || strings.ContainsAny(p, "\\\x00") {
+				t.Errorf("bad canonical path %q for %q", p, target)
+			}
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL = u
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if b := rr.Body.String(); strings.Contains(b, "SECRET") || strings.Contains(b, "HIDDEN") {
+			t.Errorf("%q served %q", target, b)
+		}
+	})
+}
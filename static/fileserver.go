@@ -0,0 +1,344 @@
+package static
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Encoding is a precompressed file encoding.
+type Encoding struct {
+	// Name is the Content-Encoding, e.g. "br".
+	Name string
+
+	// Ext is the extension of the precompressed file, e.g. ".br".
+	Ext string
+}
+
+// DefaultEncodings are the precompressed encodings FileServer looks for by
+// default, in order of preference.
+var DefaultEncodings = []Encoding{
+	{Name: "br", Ext: ".br"},
+	{Name: "zstd", Ext: ".zst"},
+	{Name: "gzip", Ext: ".gz"},
+}
+
+// Options for FileServer.
+type Options struct {
+	// Encodings are the precompressed siblings to look for, in order of
+	// preference: if "app.js.br" exists it's sent for "app.js" to clients
+	// which accept br. Defaults to DefaultEncodings; set to an empty (non-nil)
+	// slice to disable.
+	Encodings []Encoding
+
+	// Index is the file to serve for directories; defaults to "index.html".
+	Index string
+
+	// Traversal are the options for BlockTraversalWithOptions; this is
+	// ignored by FileServerFS.
+	Traversal TraversalOptions
+
+	// Dotfiles are the options for BlockDotfilesWithOptions.
+	Dotfiles DotfilesOptions
+
+	// SPA enables single-page application mode; see SPAOptions.
+	SPA *SPAOptions
+
+	// Listing enables directory listings; see ListingOptions.
+	Listing *ListingOptions
+}
+
+// FileServer serves static files from the root directory.
+//
+// Precompressed siblings (e.g. "app.js.br" or "app.js.gz") are sent instead of
+// the file if the client accepts them, with the Content-Type of the original
+// file. Range requests, conditional requests (If-Modified-Since), and HEAD are
+// supported. Requests with a trailing slash are served from the Index file, or
+// get a directory listing if Listing is set.
+//
+// Paths are normalised with Canonicalize, and path traversal and dotfiles are
+// blocked with BlockTraversalWithOptions and BlockDotfilesWithOptions.
+func FileServer(root string, opts Options) http.Handler {
+	return Canonicalize(BlockTraversalWithOptions(root, opts.Traversal)(
+		BlockDotfilesWithOptions(opts.Dotfiles)(newFileServer(os.DirFS(root), opts))))
+}
+
+// FileServerFS serves static files from fsys, such as an embed.FS or
+// zip.Reader. It works the same as FileServer, except that traversal is
+// blocked with BlockTraversalFS.
+//
+// Files which don't implement io.Seeker (such as files in a zip.Reader) are
+// read in to memory to serve them.
+func FileServerFS(fsys fs.FS, opts Options) http.Handler {
+	return Canonicalize(BlockTraversalFS(BlockDotfilesWithOptions(opts.Dotfiles)(newFileServer(fsys, opts))))
+}
+
+type fileServer struct {
+	fsys fs.FS
+	opts Options
+}
+
+func newFileServer(fsys fs.FS, opts Options) *fileServer {
+	if opts.Encodings == nil {
+		opts.Encodings = DefaultEncodings
+	}
+	if opts.Index == "" {
+		opts.Index = "index.html"
+	}
+	if opts.SPA != nil {
+		spa := *opts.SPA
+		spa.setDefaults()
+		opts.SPA = &spa
+	}
+	if opts.Listing != nil {
+		l := *opts.Listing
+		l.setDefaults()
+		opts.Listing = &l
+	}
+	return &fileServer{fsys: fsys, opts: opts}
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := fsName(r.URL.Path)
+	f, st, err := s.open(name)
+	if err != nil {
+		if s.opts.SPA != nil && notExist(err) && s.opts.SPA.fallback(r.URL.Path) {
+			s.serveIndex(w, r)
+			return
+		}
+		httpError(w, err)
+		return
+	}
+	defer f.Close() // nolint: errcheck
+
+	// Redirect so that relative links in index files work, and there is only
+	// one URL for every file.
+	if st.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			localRedirect(w, r, path.Base(r.URL.Path)+"/")
+			return
+		}
+
+		dir := name
+		name = path.Join(name, s.opts.Index)
+		f, st, err = s.open(name)
+		if err != nil {
+			if s.opts.Listing != nil && notExist(err) {
+				s.serveListing(w, r, dir)
+				return
+			}
+			httpError(w, err)
+			return
+		}
+		defer f.Close() // nolint: errcheck
+		if st.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+	} else if strings.HasSuffix(r.URL.Path, "/") {
+		localRedirect(w, r, "../"+path.Base(r.URL.Path))
+		return
+	}
+
+	if s.opts.SPA != nil {
+		s.opts.SPA.cacheHeaders(w, name)
+	}
+	s.serveFile(w, r, name, f, st)
+}
+
+// serveIndex serves the SPA index file.
+func (s *fileServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	name := fsName(s.opts.SPA.Index)
+	f, st, err := s.open(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close() // nolint: errcheck
+
+	s.opts.SPA.cacheHeaders(w, name)
+	s.serveFile(w, r, name, f, st)
+}
+
+// open a file and stat it.
+func (s *fileServer) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, st, nil
+}
+
+// serveFile serves the file, or a precompressed sibling if there is one.
+func (s *fileServer) serveFile(w http.ResponseWriter, r *http.Request, name string, f fs.File, st fs.FileInfo) {
+	h := w.Header()
+	if len(s.opts.Encodings) > 0 {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	content, err := seekable(f)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		// Sniff from the uncompressed file, as http.ServeContent would.
+		var buf [512]byte
+		n, _ := io.ReadFull(content, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+	h.Set("Content-Type", ctype)
+
+	if enc, ef, est := s.precompressed(r, name); ef != nil {
+		defer ef.Close() // nolint: errcheck
+		econtent, err := seekable(ef)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		http.ServeContent(&encodingWriter{ResponseWriter: w, enc: enc}, r, name, est.ModTime(), econtent)
+		return
+	}
+	http.ServeContent(w, r, name, st.ModTime(), content)
+}
+
+// precompressed opens the most preferred precompressed sibling of name which
+// the client accepts. The file is nil if there is none.
+func (s *fileServer) precompressed(r *http.Request, name string) (string, fs.File, fs.FileInfo) {
+	ae := r.Header.Get("Accept-Encoding")
+	if ae == "" {
+		return "", nil, nil
+	}
+	for _, enc := range s.opts.Encodings {
+		if !acceptsEncoding(ae, enc.Name) {
+			continue
+		}
+		f, st, err := s.open(name + enc.Ext)
+		if err != nil {
+			continue
+		}
+		if !st.Mode().IsRegular() {
+			_ = f.Close()
+			continue
+		}
+		return enc.Name, f, st
+	}
+	return "", nil, nil
+}
+
+// seekable gets an io.ReadSeeker for the file, reading it in to memory if it
+// doesn't support seeking.
+func seekable(f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	b, err := io.ReadAll(f)
+	return bytes.NewReader(b), err
+}
+
+// fsName converts a URL path to a name for fs.FS; "/a/../b/" becomes "b".
+func fsName(p string) string {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// encodingWriter sets the Content-Encoding header on successful responses.
+//
+// http.ServeContent doesn't set the Content-Length if the Content-Encoding is
+// already set, so it needs to be set afterwards.
+type encodingWriter struct {
+	http.ResponseWriter
+	enc string
+}
+
+func (w *encodingWriter) WriteHeader(code int) {
+	if code == http.StatusOK || code == http.StatusPartialContent {
+		w.Header().Set("Content-Encoding", w.enc)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// acceptsEncoding reports if the Accept-Encoding header value allows enc.
+func acceptsEncoding(header, enc string) bool {
+	star := false
+	for _, part := range strings.Split(header, ",") {
+		name, q := parseQuality(part)
+		switch {
+		case strings.EqualFold(name, enc):
+			return q > 0
+		case name == "*":
+			star = q > 0
+		}
+	}
+	return star
+}
+
+// parseQuality parses an "enc;q=0.5" element.
+func parseQuality(s string) (string, float64) {
+	name, params, _ := strings.Cut(s, ";")
+	q := 1.0
+	for _, p := range strings.Split(params, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return strings.TrimSpace(name), q
+}
+
+// localRedirect redirects to a path relative to the current one, keeping the
+// query string.
+func localRedirect(w http.ResponseWriter, r *http.Request, to string) {
+	if q := r.URL.RawQuery; q != "" {
+		to += "?" + q
+	}
+	w.Header().Set("Location", to)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// notExist reports if the error means the file doesn't exist, including paths
+// with a file as parent directory ("file.txt/x").
+func notExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) || errors.Is(err, syscall.ENOTDIR)
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case notExist(err):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,275 @@
+package static
+
+import (
+	"archive/zip"
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"testing/fstest"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, data := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestFileServer(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"app.js":          "var x = 1;",
+		"app.js.br":       "brotli",
+		"app.js.gz":       "gzip",
+		"style.css":       "body {}",
+		"noext":           "<html><body>hi</body></html>",
+		"dir/index.html":  "index",
+		"empty/file.txt":  "x",
+		".secret":         "secret",
+		".git/config":     "secret",
+		"dir/.env":        "secret",
+		"only.txt.gz/x":   "not a file",
+		"only.txt":        "plain",
+		"download.bin.gz": "gzip",
+		"download.bin":    "\x00\x01\x02",
+	})
+	h := FileServer(root, Options{})
+
+	cases := []struct {
+		method, path, acceptEncoding, rangeHeader string
+		wantCode                                  int
+		wantBody, wantType, wantEncoding          string
+	}{
+		{"GET", "/app.js", "", "", 200, "var x = 1;", "text/javascript; charset=utf-8", ""},
+		{"GET", "/app.js", "gzip, deflate, br", "", 200, "brotli", "text/javascript; charset=utf-8", "br"},
+		{"GET", "/app.js", "gzip", "", 200, "gzip", "text/javascript; charset=utf-8", "gzip"},
+		{"GET", "/app.js", "br;q=0, gzip;q=0.5", "", 200, "gzip", "text/javascript; charset=utf-8", "gzip"},
+		{"GET", "/app.js", "*", "", 200, "brotli", "text/javascript; charset=utf-8", "br"},
+		{"GET", "/app.js", "*, br;q=0", "", 200, "gzip", "text/javascript; charset=utf-8", "gzip"},
+		{"GET", "/app.js", "zstd", "", 200, "var x = 1;", "text/javascript; charset=utf-8", ""},
+		{"GET", "/app.js", "br", "bytes=0-2", 206, "bro", "text/javascript; charset=utf-8", "br"},
+		{"GET", "/app.js", "", "bytes=4-", 206, "x = 1;", "text/javascript; charset=utf-8", ""},
+		{"HEAD", "/app.js", "br", "", 200, "", "text/javascript; charset=utf-8", "br"},
+		{"GET", "/style.css", "br", "", 200, "body {}", "text/css; charset=utf-8", ""},
+		{"GET", "/noext", "", "", 200, "<html><body>hi</body></html>", "text/html; charset=utf-8", ""},
+		{"GET", "/download.bin", "gzip", "", 200, "gzip", "application/octet-stream", "gzip"},
+		{"GET", "/only.txt", "gzip", "", 200, "plain", "text/plain; charset=utf-8", ""},
+		{"GET", "/dir/", "", "", 200, "index", "text/html; charset=utf-8", ""},
+		{"GET", "/empty/", "", "", 404, "404 page not found\n", "text/plain; charset=utf-8", ""},
+		{"GET", "/nonexistent", "", "", 404, "404 page not found\n", "text/plain; charset=utf-8", ""},
+		{"GET", "/.secret", "", "", 404, "", "", ""},
+		{"GET", "/.git/config", "", "", 404, "", "", ""},
+		{"GET", "/dir/.env", "", "", 404, "", "", ""},
+		{"POST", "/app.js", "", "", 405, "Method Not Allowed\n", "text/plain; charset=utf-8", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path+" "+tc.acceptEncoding+" "+tc.rangeHeader, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			if tc.rangeHeader != "" {
+				req.Header.Set("Range", tc.rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %d, got %d", tc.wantCode, rr.Code)
+			}
+			if b := rr.Body.String(); b != tc.wantBody {
+				t.Errorf("body wrong\nout:  %#v\nwant: %#v", b, tc.wantBody)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != tc.wantType {
+				t.Errorf("Content-Type wrong: %#v", ct)
+			}
+			if ce := rr.Header().Get("Content-Encoding"); ce != tc.wantEncoding {
+				t.Errorf("Content-Encoding wrong: %#v", ce)
+			}
+			if rr.Code < 300 {
+				if v := rr.Header().Get("Vary"); v != "Accept-Encoding" {
+					t.Errorf("Vary wrong: %#v", v)
+				}
+				if tc.method == "GET" && rr.Header().Get("Content-Length") != strconv.Itoa(len(tc.wantBody)) {
+					t.Errorf("Content-Length wrong: %#v", rr.Header().Get("Content-Length"))
+				}
+				if tc.method == "HEAD" && rr.Header().Get("Content-Length") != "6" {
+					t.Errorf("Content-Length wrong for HEAD: %#v", rr.Header().Get("Content-Length"))
+				}
+			}
+		})
+	}
+}
+
+//go:embed testdata/site
+var embedded embed.FS
+
+func TestFileServerFS(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"index.html":    {Data: []byte("<p>map</p>")},
+		"css/style.css": {Data: []byte("body {}")},
+		"app.js":        {Data: []byte("var x = 1;")},
+		"app.js.gz":     {Data: []byte("gzip")},
+		".env":          {Data: []byte("secret")},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"index.html", "css/style.css", "app.js", "app.js.gz", ".env"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write(mapFS[name].Data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipFS, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embedFS, err := fs.Sub(embedded, "testdata/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		fsys      fs.FS
+		wantIndex string
+	}{
+		{"map", mapFS, "<p>map</p>"},
+		{"zip", zipFS, "<p>map</p>"},
+		{"embed", embedFS, "<p>embedded</p>\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := FileServerFS(tc.fsys, Options{})
+			do := func(path, acceptEncoding, rangeHeader string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", path, nil)
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+				req.Header.Set("Range", rangeHeader)
+				rr := httptest.NewRecorder()
+				h.ServeHTTP(rr, req)
+				return rr
+			}
+
+			if rr := do("/", "", ""); rr.Code != 200 || rr.Body.String() != tc.wantIndex {
+				t.Errorf("index wrong: %d %#v", rr.Code, rr.Body.String())
+			}
+			if rr := do("/css", "", ""); rr.Code != 301 || rr.Header().Get("Location") != "css/" {
+				t.Errorf("no redirect: %d %#v", rr.Code, rr.Header().Get("Location"))
+			}
+			rr := do("/css/style.css", "", "bytes=0-3")
+			if rr.Code != 206 || rr.Body.String() != "body" || rr.Header().Get("Content-Type") != "text/css; charset=utf-8" {
+				t.Errorf("range wrong: %d %#v %#v", rr.Code, rr.Body.String(), rr.Header().Get("Content-Type"))
+			}
+			if rr := do("/../../etc/passwd", "", ""); rr.Code != 403 {
+				t.Errorf("traversal not blocked: %d", rr.Code)
+			}
+			if rr := do("/.env", "", ""); rr.Code != 404 {
+				t.Errorf("dotfile not blocked: %d", rr.Code)
+			}
+			if rr := do("/nonexistent", "", ""); rr.Code != 404 {
+				t.Errorf("want 404, got %d", rr.Code)
+			}
+
+			if tc.name != "embed" {
+				rr := do("/app.js", "gzip", "")
+				if rr.Body.String() != "gzip" || rr.Header().Get("Content-Encoding") != "gzip" ||
+					rr.Header().Get("Content-Length") != "4" {
+					t.Errorf("precompressed wrong: %#v %v", rr.Body.String(), rr.Header())
+				}
+			}
+		})
+	}
+}
+
+func TestFileServerDotfiles(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		".well-known/security.txt": "Contact: security@example.com",
+		".git/config":              "secret",
+	})
+	h := FileServer(root, Options{Dotfiles: DotfilesOptions{
+		Allow:  []string{"/.well-known/"},
+		Status: http.StatusForbidden,
+	}})
+
+	for _, tc := range []struct {
+		path     string
+		wantCode int
+	}{
+		{"/.well-known/security.txt", 200},
+		{"/.git/config", 403},
+	} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", tc.path, nil))
+		if rr.Code != tc.wantCode {
+			t.Errorf("%s: want code %d, got %d", tc.path, tc.wantCode, rr.Code)
+		}
+	}
+}
+
+func TestFileServerRedirect(t *testing.T) {
+	root := writeFiles(t, map[string]string{"dir/index.html": "index", "file.txt": "x"})
+	h := FileServer(root, Options{Encodings: []Encoding{}})
+
+	cases := []struct{ path, want string }{
+		{"/dir", "dir/"},
+		{"/dir?x=1", "dir/?x=1"},
+		{"/file.txt/", "../file.txt"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", tc.path, nil))
+			if rr.Code != http.StatusMovedPermanently {
+				t.Errorf("want code 301, got %d", rr.Code)
+			}
+			if l := rr.Header().Get("Location"); l != tc.want {
+				t.Errorf("Location wrong: %#v", l)
+			}
+			if v := rr.Header().Get("Vary"); v != "" {
+				t.Errorf("Vary set: %#v", v)
+			}
+		})
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		header, enc string
+		want        bool
+	}{
+		{"gzip", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.0", "gzip", false},
+		{"gzip;q=0.001", "gzip", true},
+		{"deflate, gzip", "br", false},
+		{"*", "br", true},
+		{"*;q=0", "br", false},
+		{"*;q=0, br", "br", true},
+		{"", "br", false},
+	}
+	for _, tc := range cases {
+		if got := acceptsEncoding(tc.header, tc.enc); got != tc.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v; want %v", tc.header, tc.enc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package static
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListingOptions enables directory listings for FileServer, for directories
+// without an Index file.
+//
+// The listing is HTML, or JSON if the client prefers application/json in the
+// Accept header. It can be controlled with query parameters:
+//
+//	sort    name (default), size, or modified
+//	order   asc (default) or desc
+//	page    page number, starting at 1
+//
+// Dotfiles are hidden, unless they're allowed by Options.Dotfiles.
+type ListingOptions struct {
+	// PageSize is the maximum number of entries per page; defaults to 500.
+	PageSize int
+
+	// Template renders the HTML listing, with a Listing as data. Defaults to
+	// a plain table.
+	Template *template.Template
+}
+
+// Listing is a directory listing.
+type Listing struct {
+	Path    string         `json:"path"`
+	Entries []ListingEntry `json:"entries"`
+	Sort    string         `json:"sort"`
+	Order   string         `json:"order"`
+	Page    int            `json:"page"`
+	Pages   int            `json:"pages"`
+	Total   int            `json:"total"`
+}
+
+// ListingEntry is a file or directory in a Listing.
+type ListingEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// URL gets the relative URL for the entry.
+func (e ListingEntry) URL() string {
+	u := (&url.URL{Path: "./" + e.Name}).String()
+	if e.Dir {
+		u += "/"
+	}
+	return u
+}
+
+// PageURL gets the relative URL for a page with the current sort order.
+func (l Listing) PageURL(page int) string {
+	return "?" + url.Values{
+		"sort":  {l.Sort},
+		"order": {l.Order},
+		"page":  {strconv.Itoa(page)},
+	}.Encode()
+}
+
+// SortURL gets the relative URL to sort by the column; the order is toggled
+// if the listing is already sorted by it.
+func (l Listing) SortURL(col string) string {
+	order := "asc"
+	if l.Sort == col && l.Order == "asc" {
+		order = "desc"
+	}
+	return "?" + url.Values{"sort": {col}, "order": {order}}.Encode()
+}
+
+func (opts *ListingOptions) setDefaults() {
+	if opts.PageSize <= 0 {
+		opts.PageSize = 500
+	}
+	if opts.Template == nil {
+		opts.Template = listingTemplate
+	}
+}
+
+// serveListing serves the listing for the directory name; the URL path must
+// end with a slash.
+func (s *fileServer) serveListing(w http.ResponseWriter, r *http.Request, name string) {
+	dir, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	l := Listing{
+		Path:    r.URL.Path,
+		Entries: make([]ListingEntry, 0, len(dir)),
+		Sort:    q.Get("sort"),
+		Order:   q.Get("order"),
+	}
+	switch l.Sort {
+	case "size", "modified":
+	default:
+		l.Sort = "name"
+	}
+	if l.Order != "desc" {
+		l.Order = "asc"
+	}
+
+	for _, d := range dir {
+		if !s.opts.Dotfiles.allowed(path.Join("/", name, d.Name())) {
+			continue
+		}
+		st, err := d.Info()
+		if err != nil {
+			continue // Removed since ReadDir.
+		}
+		e := ListingEntry{Name: d.Name(), Dir: d.IsDir(), Modified: st.ModTime().UTC()}
+		if !e.Dir {
+			e.Size = st.Size()
+		}
+		l.Entries = append(l.Entries, e)
+	}
+	sortListing(l.Entries, l.Sort, l.Order == "desc")
+
+	l.Total = len(l.Entries)
+	l.Pages = (l.Total + s.opts.Listing.PageSize - 1) / s.opts.Listing.PageSize
+	if l.Pages == 0 {
+		l.Pages = 1
+	}
+	l.Page, _ = strconv.Atoi(q.Get("page"))
+	if l.Page < 1 || l.Page > l.Pages {
+		l.Page = 1
+	}
+	start := (l.Page - 1) * s.opts.Listing.PageSize
+	end := start + s.opts.Listing.PageSize
+	if end > l.Total {
+		end = l.Total
+	}
+	l.Entries = l.Entries[start:end]
+
+	w.Header().Add("Vary", "Accept")
+	if mediaQuality(r.Header.Get("Accept"), "application/json") >
+		mediaQuality(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodHead {
+			_ = json.NewEncoder(w).Encode(l)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method != http.MethodHead {
+		_ = s.opts.Listing.Template.Execute(w, l)
+	}
+}
+
+// sortListing sorts the entries by the column, with directories first.
+func sortListing(entries []ListingEntry, col string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch col {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+// mediaQuality gets the q-value for the media type from the Accept header.
+// An empty header accepts everything.
+func mediaQuality(accept, mt string) float64 {
+	if accept == "" {
+		return 1
+	}
+	var (
+		q           = 0.0
+		specificity = -1
+	)
+	for _, part := range strings.Split(accept, ",") {
+		name, pq := parseQuality(part)
+		var s int
+		switch {
+		case strings.EqualFold(name, mt):
+			s = 2
+		case strings.HasSuffix(name, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(name, "*")):
+			s = 1
+		case name == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = pq, s
+		}
+	}
+	return q
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"pages": func(n int) []int {
+		p := make([]int, n)
+		for i := range p {
+			p[i] = i + 1
+		}
+		return p
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<thead><tr>
+	<th><a href="{{.SortURL "name"}}">Name</a></th>
+	<th><a href="{{.SortURL "size"}}">Size</a></th>
+	<th><a href="{{.SortURL "modified"}}">Modified</a></th>
+</tr></thead>
+<tbody>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.Modified.Format "2006-01-02 15:04:05"}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- if gt .Pages 1}}
+<p>{{range pages .Pages}}{{if eq . $.Page}}{{.}} {{else}}<a href="{{$.PageURL .}}">{{.}}</a> {{end}}{{end}}</p>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,158 @@
+package static
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListing(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"logs/b.log":                  "bb",
+		"logs/a.log":                  "aaaa",
+		"logs/c d.log":                "c",
+		"logs/archive/old.log":        "old",
+		"logs/.secret":                "secret",
+		"logs/.well-known/x":          "x",
+		"site/index.html":             "index",
+		"logs/archive/.git/HEAD":      "ref",
+		"logs/archive/2024/01.log":    "1",
+		"logs/archive/2024/02.log.gz": "2",
+	})
+	mod := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"logs/a.log", "logs/b.log", "logs/c d.log"} {
+		if err := os.Chtimes(filepath.Join(root, name), mod, mod.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := Options{
+		Listing:  &ListingOptions{PageSize: 2},
+		Dotfiles: DotfilesOptions{Allow: []string{"/logs/.well-known/"}},
+	}
+	h := FileServer(root, opts)
+
+	get := func(t *testing.T, target, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	names := func(t *testing.T, rr *httptest.ResponseRecorder) ([]string, Listing) {
+		t.Helper()
+		if rr.Code != 200 || rr.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("wrong response: %d %v", rr.Code, rr.Header())
+		}
+		var l Listing
+		if err := json.Unmarshal(rr.Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		var n []string
+		for _, e := range l.Entries {
+			n = append(n, e.Name)
+		}
+		return n, l
+	}
+
+	t.Run("json", func(t *testing.T) {
+		cases := []struct {
+			query string
+			want  []string
+		}{
+			{"", []string{".well-known", "archive"}},
+			{"?page=2", []string{"a.log", "b.log"}},
+			{"?page=3", []string{"c d.log"}},
+			{"?page=4", []string{".well-known", "archive"}},
+			{"?sort=size&order=desc&page=2", []string{"a.log", "b.log"}},
+			{"?sort=size&page=2", []string{"c d.log", "b.log"}},
+			{"?sort=modified&order=desc&page=2", []string{"c d.log", "b.log"}},
+			{"?sort=nonsense&order=nonsense&page=3", []string{"c d.log"}},
+		}
+		for _, tc := range cases {
+			t.Run(tc.query, func(t *testing.T) {
+				got, l := names(t, get(t, "/logs/"+tc.query, "application/json"))
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("wrong entries\nout:  %#v\nwant: %#v", got, tc.want)
+				}
+				if l.Total != 5 || l.Pages != 3 || l.Path != "/logs/" {
+					t.Errorf("wrong listing: %#v", l)
+				}
+			})
+		}
+
+		_, l := names(t, get(t, "/logs/?page=2", "text/html;q=0.9, application/json"))
+		want := ListingEntry{Name: "a.log", Size: 4, Modified: mod}
+		if l.Entries[0] != want {
+			t.Errorf("wrong entry\nout:  %#v\nwant: %#v", l.Entries[0], want)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		rr := get(t, "/logs/?page=3", "text/html,application/xhtml+xml,application/json;q=0.9,*/*;q=0.8")
+		if rr.Code != 200 || rr.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("wrong response: %d %v", rr.Code, rr.Header())
+		}
+		b := rr.Body.String()
+		for _, want := range []string{
+			"<title>Index of /logs/</title>",
+			`<a href="./c%20d.log">c d.log</a></td><td>1</td><td>2024-01-01 02:00:00</td>`,
+			`<a href="?order=asc&amp;page=2&amp;sort=name">2</a>`,
+			`<a href="?order=desc&amp;sort=name">Name</a>`,
+			`<a href="../">../</a>`,
+		} {
+			if !strings.Contains(b, want) {
+				t.Errorf("%q not in body:\n%s", want, b)
+			}
+		}
+	})
+
+	t.Run("hidden", func(t *testing.T) {
+		got, _ := names(t, get(t, "/logs/archive/", "application/json"))
+		if want := []string{"2024", "old.log"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong entries\nout:  %#v\nwant: %#v", got, want)
+		}
+		if rr := get(t, "/logs/archive/.git/", "application/json"); rr.Code != 404 {
+			t.Errorf("listed hidden directory: %d", rr.Code)
+		}
+	})
+
+	t.Run("index", func(t *testing.T) {
+		if rr := get(t, "/site/", ""); rr.Body.String() != "index" {
+			t.Errorf("index not served: %q", rr.Body.String())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		FileServer(root, Options{}).ServeHTTP(rr, httptest.NewRequest("GET", "/logs/", nil))
+		if rr.Code != 404 {
+			t.Errorf("want code 404, got %d", rr.Code)
+		}
+	})
+}
+
+func TestMediaQuality(t *testing.T) {
+	cases := []struct {
+		accept, mt string
+		want       float64
+	}{
+		{"", "application/json", 1},
+		{"application/json", "application/json", 1},
+		{"text/html", "application/json", 0},
+		{"*/*;q=0.5", "application/json", 0.5},
+		{"application/*;q=0.7, */*;q=0.1", "application/json", 0.7},
+		{"application/json;q=0, */*", "application/json", 0},
+	}
+	for _, tc := range cases {
+		if got := mediaQuality(tc.accept, tc.mt); got != tc.want {
+			t.Errorf("mediaQuality(%q, %q) = %v; want %v", tc.accept, tc.mt, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package static
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/teamwork/middleware/cache"
+)
+
+// SPAOptions enables single-page application mode for FileServer: requests for
+// paths which don't exist are served the index file, so the application can
+// route them in the browser. Requests for assets which don't exist still get a
+// 404.
+//
+// The index is served with Cache-Control: no-cache so new deploys are picked up
+// right away, and fingerprinted assets with cache.PolicyImmutable.
+type SPAOptions struct {
+	// Index is the file to serve for unknown paths; defaults to
+	// "/index.html".
+	Index string
+
+	// AssetExtensions are the extensions of assets, e.g. ".js" or ".png".
+	// Defaults to treating every path with an extension as an asset.
+	AssetExtensions []string
+
+	// Exclude are path prefixes which are never served the index, e.g.
+	// "/api/".
+	Exclude []string
+
+	// Fingerprinted reports if the file name contains a content hash. Defaults
+	// to names like "app.3f2a9c1b.js" (webpack) or "index-BqFkGx3a.js" (vite).
+	Fingerprinted func(name string) bool
+}
+
+func (opts *SPAOptions) setDefaults() {
+	if opts.Index == "" {
+		opts.Index = "/index.html"
+	}
+	if opts.Fingerprinted == nil {
+		opts.Fingerprinted = fingerprinted
+	}
+}
+
+// fallback reports if the index should be served for the missing URL path.
+func (opts *SPAOptions) fallback(p string) bool {
+	for _, e := range opts.Exclude {
+		if strings.HasPrefix(p, e) {
+			return false
+		}
+	}
+
+	ext := path.Ext(p)
+	if opts.AssetExtensions == nil {
+		return ext == ""
+	}
+	for _, a := range opts.AssetExtensions {
+		if strings.EqualFold(ext, a) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	noCache   = cache.PolicyNoCache.String()
+	immutable = cache.PolicyImmutable.String()
+)
+
+// cacheHeaders sets the Cache-Control header for the file name, if it's not set
+// yet.
+func (opts *SPAOptions) cacheHeaders(w http.ResponseWriter, name string) {
+	if w.Header().Get("Cache-Control") != "" {
+		return
+	}
+	switch {
+	case name == fsName(opts.Index):
+		w.Header().Set("Cache-Control", noCache)
+	case opts.Fingerprinted(name):
+		w.Header().Set("Cache-Control", immutable)
+	}
+}
+
+var fingerprintRe = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})\.[A-Za-z0-9]+$`)
+
+// fingerprinted reports if the name has a hex hash, or a base64-like hash with
+// at least one digit (so "jquery-slimmest.js" isn't seen as fingerprinted).
+func fingerprinted(name string) bool {
+	m := fingerprintRe.FindStringSubmatch(path.Base(name))
+	if m == nil {
+		return false
+	}
+	hash := m[1]
+	return strings.Trim(hash, "0123456789abcdef") == "" ||
+		strings.ContainsAny(hash, "0123456789")
+}
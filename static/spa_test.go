@@ -0,0 +1,83 @@
+package static
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSPA(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"index.html":               "index",
+		"app.3f2a9c1b.js":          "webpack",
+		"assets/index-Bq3kGx3a.js": "vite",
+		"favicon.ico":              "icon",
+		"docs/index.html":          "docs",
+	})
+
+	cases := []struct {
+		name, path string
+		opts       SPAOptions
+		wantCode   int
+		wantBody   string
+		wantCache  string
+	}{
+		{"index", "/", SPAOptions{}, 200, "index", "no-cache"},
+		{"index file", "/index.html", SPAOptions{}, 200, "index", "no-cache"},
+		{"route", "/users/42", SPAOptions{}, 200, "index", "no-cache"},
+		{"route slash", "/users/42/", SPAOptions{}, 200, "index", "no-cache"},
+		{"under file", "/favicon.ico/x", SPAOptions{}, 200, "index", "no-cache"},
+		{"missing asset", "/missing.js", SPAOptions{}, 404, "404 page not found\n", ""},
+		{"webpack asset", "/app.3f2a9c1b.js", SPAOptions{}, 200, "webpack", "public,max-age=31536000,immutable"},
+		{"vite asset", "/assets/index-Bq3kGx3a.js", SPAOptions{}, 200, "vite", "public,max-age=31536000,immutable"},
+		{"plain asset", "/favicon.ico", SPAOptions{}, 200, "icon", ""},
+		{"other dir index", "/docs/", SPAOptions{}, 200, "docs", ""},
+		{"exclude", "/api/users", SPAOptions{Exclude: []string{"/api/"}}, 404, "404 page not found\n", ""},
+		{"asset extensions", "/users/john.doe", SPAOptions{AssetExtensions: []string{".js", ".css"}}, 200, "index", "no-cache"},
+		{"asset extensions miss", "/app.JS", SPAOptions{AssetExtensions: []string{".js", ".css"}}, 404, "404 page not found\n", ""},
+		{"custom index", "/users/42", SPAOptions{Index: "/docs/index.html"}, 200, "docs", "no-cache"},
+		{"custom fingerprint", "/favicon.ico", SPAOptions{Fingerprinted: func(string) bool { return true }},
+			200, "icon", "public,max-age=31536000,immutable"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			h := FileServer(root, Options{SPA: &opts})
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", tc.path, nil))
+
+			if rr.Code != tc.wantCode {
+				t.Errorf("want code %d, got %d", tc.wantCode, rr.Code)
+			}
+			if b := rr.Body.String(); b != tc.wantBody {
+				t.Errorf("body wrong\nout:  %#v\nwant: %#v", b, tc.wantBody)
+			}
+			if c := rr.Header().Get("Cache-Control"); c != tc.wantCache {
+				t.Errorf("Cache-Control wrong: %#v", c)
+			}
+		})
+	}
+}
+
+func TestFingerprinted(t *testing.T) {
+	cases := []struct {
+		name string
+		want bool
+	}{
+		{"app.js", false},
+		{"app.3f2a9c1b.js", true},
+		{"app.deadbeef.css", true},
+		{"main.3f2a9c1b3f2a9c1b.chunk.js", false},
+		{"main.3f2a9c1b3f2a9c1b.js", true},
+		{"/assets/index-BqFkGx3a.js", true},
+		{"jquery-slimmest.js", false},
+		{"jquery-3.6.0.min.js", false},
+		{"logo.svg", false},
+		{"bundle.20240101.js", true},
+	}
+	for _, tc := range cases {
+		if got := fingerprinted(tc.name); got != tc.want {
+			t.Errorf("fingerprinted(%q) = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
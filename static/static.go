@@ -1,33 +1,91 @@
-// Package static contains some middlewares for static file routes.
+// Package static serves static files, and contains some middlewares for static
+// file routes.
 package static // import "github.com/teamwork/middleware/static"
 
 import (
 	"fmt"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
 // BlockTraversal prevents "../../../../../etc/passwd" type path traversal
-// attacks for static routes: all paths must begin with root path.
+// attacks for static routes: all paths must be inside the root directory.
+//
+// This only checks the path lexically; symlinks inside root can still point
+// outside of it. Use BlockTraversalWithOptions to resolve symlinks.
+//
+// Paths rejected by Canonicalize get a 400 Bad Request.
 func BlockTraversal(root string) func(http.Handler) http.Handler {
+	return BlockTraversalWithOptions(root, TraversalOptions{})
+}
+
+// TraversalOptions for BlockTraversalWithOptions.
+type TraversalOptions struct {
+	// EvalSymlinks resolves symlinks in the root and request path, and
+	// requires the resolved path to be inside the resolved root.
+	EvalSymlinks bool
+
+	// AllowSymlinks are trusted symlinks which may point outside root, as
+	// paths relative to root (e.g. "vendor/shared"). Their targets are
+	// resolved once on startup, and requests below them must stay inside that
+	// target.
+	AllowSymlinks []string
+}
+
+type trustedLink struct{ path, target string }
+
+// BlockTraversalWithOptions prevents path traversal attacks like
+// BlockTraversal, with the given options.
+func BlockTraversalWithOptions(root string, opts TraversalOptions) func(http.Handler) http.Handler {
 	rootAbs, err := filepath.Abs(root)
 	if err != nil {
 		panic(fmt.Errorf("cannot get absolute path for %v: %v", root, err))
 	}
 	root = rootAbs
 
+	var (
+		realRoot string
+		trusted  []trustedLink
+	)
+	if opts.EvalSymlinks {
+		realRoot, err = filepath.EvalSymlinks(root)
+		if err != nil {
+			panic(fmt.Errorf("cannot resolve symlinks for %v: %v", root, err))
+		}
+		for _, l := range opts.AllowSymlinks {
+			p := filepath.Join(root, filepath.FromSlash(l))
+			target, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				panic(fmt.Errorf("cannot resolve symlink %v: %v", p, err))
+			}
+			trusted = append(trusted, trustedLink{path: p, target: target})
+		}
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := canonicalPath(r.URL)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 
-			abs, err := filepath.Abs(root + r.URL.Path)
+			abs, err := filepath.Abs(root + p)
 			if err != nil {
 				w.WriteHeader(http.StatusNotFound)
 				_, _ = fmt.Fprintf(w, "Not found: %v", r.URL.Path)
 				return
 			}
 
-			if !strings.HasPrefix(abs, root) {
+			if !within(root, abs) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			if opts.EvalSymlinks && !symlinkAllowed(realRoot, trusted, abs) {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			}
@@ -37,27 +95,195 @@ func BlockTraversal(root string) func(http.Handler) http.Handler {
 	}
 }
 
+// symlinkAllowed reports if the real path of abs is inside realRoot, or inside
+// the target of a trusted symlink abs is below.
+func symlinkAllowed(realRoot string, trusted []trustedLink, abs string) bool {
+	resolved, err := realPath(abs)
+	if err != nil {
+		return false
+	}
+	if within(realRoot, resolved) {
+		return true
+	}
+	for _, l := range trusted {
+		if within(l.path, abs) && within(l.target, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// realPath resolves all symlinks in p. Unlike filepath.EvalSymlinks the path
+// doesn't need to exist: the longest existing prefix is resolved. Dangling
+// symlinks are an error.
+func realPath(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, lerr := os.Lstat(p); lerr == nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(p)
+	if dir == p {
+		return "", err
+	}
+	realDir, err := realPath(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(realDir, filepath.Base(p)), nil
+}
+
+// within reports if path p is root or inside it. Both must be clean and
+// absolute.
+func within(root, p string) bool {
+	if p == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(p, root)
+}
+
+// BlockTraversalFS prevents "../../../../../etc/passwd" type path traversal
+// attacks for static routes served from an fs.FS, such as an embed.FS. There is
+// no root directory to compare against, so paths which would go above the root
+// of the URL path are rejected.
+//
+// BlockDotfiles works on the URL path, so it can be used with an fs.FS as-is.
+func BlockTraversalFS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := canonicalPath(r.URL)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if escapes(p) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// escapes reports if the slash-separated path goes above its root with "..".
+func escapes(p string) bool {
+	depth := 0
+	for _, seg := range strings.Split(p, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
 // BlockDotfiles prevents access to any files or directories that start with a
 // dot (.).
 //
 // This includes the filename itself (e.g. ".gitignore") or any parent directory
 // starting with a dit (e.g. ".git/foo/bar").
+//
+// Paths rejected by Canonicalize get a 400 Bad Request.
 func BlockDotfiles(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return BlockDotfilesWithOptions(DotfilesOptions{})(next)
+}
 
-		// Run a simple check first; after that test it again on the absolute
-		// path to be sure we're not blocking access to e.g. /../foo or /./foo.
-		//
-		// path.Abs is comparatively slow, and this makes this middleware about
-		// twice as fast.
-		if strings.Contains(r.URL.Path, "/.") {
-			abs, _ := filepath.Abs(r.URL.Path)
-			if strings.Contains(abs, "/.") {
-				w.WriteHeader(http.StatusNotFound)
-				return
+// DotfilesOptions for BlockDotfilesWithOptions.
+type DotfilesOptions struct {
+	// Allow are dotfile paths which can be accessed. An entry ending with a
+	// slash allows everything below it (except other dotfiles), e.g.
+	// "/.well-known/". Other entries are matched against the full path with
+	// path.Match, e.g. "/.well-known/security.txt" or "/.well-known/*".
+	//
+	// Globs don't allow other dotfiles either: "/.well-known/*" doesn't match
+	// "/.well-known/.htpasswd", as only the part before the first glob
+	// character can contain dotfiles. Use "/.well-known/.*" to allow them.
+	Allow []string
+
+	// Status to respond with for blocked paths; defaults to 404 Not Found,
+	// which doesn't reveal if the file exists. 403 Forbidden is the other
+	// common choice.
+	Status int
+}
+
+// allowed reports if the clean absolute path is allowed.
+func (opts DotfilesOptions) allowed(abs string) bool {
+	if !strings.Contains(abs, "/.") {
+		return true
+	}
+	for _, a := range opts.Allow {
+		if strings.HasSuffix(a, "/") {
+			if abs+"/" == a {
+				return true
+			}
+			if strings.HasPrefix(abs, a) && !strings.Contains(abs[len(a)-1:], "/.") {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(a, abs); ok {
+			// The literal prefix was matched exactly, so check the rest of
+			// the path from the slash before it.
+			lit := a
+			if i := strings.IndexAny(a, `*?[\`); i != -1 {
+				lit = a[:i]
+			}
+			if lit == "" || !strings.Contains(abs[len(lit)-1:], "/.") {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		next.ServeHTTP(w, r)
-	})
+// BlockDotfilesWithOptions prevents access to dotfiles like BlockDotfiles, with
+// the given options. For example, to allow ACME challenges and security.txt:
+//
+//	static.BlockDotfilesWithOptions(static.DotfilesOptions{
+//	    Allow: []string{"/.well-known/acme-challenge/", "/.well-known/security.txt"},
+//	})
+func BlockDotfilesWithOptions(opts DotfilesOptions) func(http.Handler) http.Handler {
+	if opts.Status == 0 {
+		opts.Status = http.StatusNotFound
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := canonicalPath(r.URL)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			// Run a simple check first; after that test it again on the
+			// absolute path to be sure we're not blocking access to e.g. /../foo
+			// or /./foo.
+			//
+			// path.Abs is comparatively slow, and this makes this middleware
+			// about twice as fast.
+			if strings.Contains(p, "/.") {
+				abs, _ := filepath.Abs(p)
+				if !opts.allowed(filepath.ToSlash(abs)) {
+					w.WriteHeader(opts.Status)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
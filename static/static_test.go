@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/teamwork/test"
@@ -27,6 +29,9 @@ func TestBlockTraversal(t *testing.T) {
 		{"/root", "/some/../../path", 403},
 		{"/root", "/some/./././path", 200},
 		{"/root", "/some/\\/././path", 200},
+		{"/srv/static", "/../static-private/file", 403},
+		{"/srv/static/", "/../static-private/file", 403},
+		{"/", "/../etc/passwd", 200},
 	}
 
 	for i, tc := range cases {
@@ -47,6 +52,101 @@ func TestBlockTraversal(t *testing.T) {
 	}
 }
 
+func TestBlockTraversalSymlinks(t *testing.T) {
+	base := t.TempDir()
+	for _, d := range []string{"static/sub", "private", "shared", "static-private"} {
+		if err := os.MkdirAll(filepath.Join(base, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"static/ok.txt", "static/sub/a.txt", "private/secret.txt", "shared/lib.js", "static-private/x.txt"} {
+		if err := os.WriteFile(filepath.Join(base, f), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"static/inside":   filepath.Join(base, "static/sub"),
+		"static/etc":      filepath.Join(base, "private"),
+		"static/shared":   filepath.Join(base, "shared"),
+		"static/dangling": filepath.Join(base, "nonexistent"),
+		"shared/out":      filepath.Join(base, "private"),
+	} {
+		if err := os.Symlink(target, filepath.Join(base, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(base, "static")
+
+	cases := []struct {
+		request  string
+		opts     TraversalOptions
+		wantCode int
+	}{
+		{"/ok.txt", TraversalOptions{EvalSymlinks: true}, 200},
+		{"/inside/a.txt", TraversalOptions{EvalSymlinks: true}, 200},
+		{"/nonexistent/file", TraversalOptions{EvalSymlinks: true}, 200},
+		{"/etc/secret.txt", TraversalOptions{}, 200},
+		{"/etc/secret.txt", TraversalOptions{EvalSymlinks: true}, 403},
+		{"/etc", TraversalOptions{EvalSymlinks: true}, 403},
+		{"/etc/nonexistent", TraversalOptions{EvalSymlinks: true}, 403},
+		{"/dangling", TraversalOptions{EvalSymlinks: true}, 403},
+		{"/../static-private/x.txt", TraversalOptions{}, 403},
+		{"/shared/lib.js", TraversalOptions{EvalSymlinks: true}, 403},
+		{"/shared/lib.js", TraversalOptions{EvalSymlinks: true, AllowSymlinks: []string{"shared"}}, 200},
+		{"/shared/out/secret.txt", TraversalOptions{EvalSymlinks: true, AllowSymlinks: []string{"shared"}}, 403},
+		{"/etc/secret.txt", TraversalOptions{EvalSymlinks: true, AllowSymlinks: []string{"shared"}}, 403},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.request, nil)
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+
+			rr := test.HTTP(t, req, BlockTraversalWithOptions(root, tc.opts)(handle{}))
+			if rr.Code != tc.wantCode {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", rr.Code, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestBlockTraversalFS(t *testing.T) {
+	cases := []struct {
+		request  string
+		wantCode int
+	}{
+		{"/some/path", 200},
+		{"/some/path.ext", 200},
+		{"/some/../path..ext", 200},
+		{"/some/../path", 200},
+		{"/some/../../path", 403},
+		{"/../path", 403},
+		{"/..", 403},
+		{"/some/./././path", 200},
+		{"/some/\\/././path", 200},
+		{"/some/path/..", 200},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.request, nil)
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+
+			rr := test.HTTP(t, req, BlockTraversalFS(handle{}))
+			if rr.Code != tc.wantCode {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", rr.Code, tc.wantCode)
+			}
+			if rr.Code != 200 && rr.Body.String() != "" {
+				t.Errorf("expected body to be empty: %#v", rr.Body.String())
+			}
+		})
+	}
+}
+
 func TestBlockDotfiles(t *testing.T) {
 	cases := []struct {
 		request  string
@@ -80,6 +180,63 @@ func TestBlockDotfiles(t *testing.T) {
 	}
 }
 
+func TestBlockDotfilesWithOptions(t *testing.T) {
+	opts := DotfilesOptions{Allow: []string{
+		"/.well-known/acme-challenge/",
+		"/.well-known/security.txt",
+		"/.well-known/apple-*",
+	}}
+
+	cases := []struct {
+		request  string
+		opts     DotfilesOptions
+		wantCode int
+	}{
+		{"/some/path", opts, 200},
+		{"/.well-known/acme-challenge/token", opts, 200},
+		{"/.well-known/acme-challenge", opts, 200},
+		{"/.well-known/acme-challenge/", opts, 200},
+		{"/.well-known/acme-challenge/a/b", opts, 200},
+		{"/.well-known/acme-challenge/.hidden", opts, 404},
+		{"/.well-known/acme-challenge/../../.git/config", opts, 404},
+		{"/x/../.well-known/acme-challenge/token", opts, 200},
+		{"/.well-known/security.txt", opts, 200},
+		{"/.well-known/security.txt.bak", opts, 404},
+		{"/.well-known/apple-app-site-association", opts, 200},
+		{"/.well-known/apple-app-site-association/x", opts, 404},
+		{"/.well-known/other", opts, 404},
+		{"/.well-known", opts, 404},
+		{"/.git/config", opts, 404},
+		{"/.git/config", DotfilesOptions{Status: 403}, 403},
+		{"/.well-known/security.txt", DotfilesOptions{Status: 403}, 403},
+		{`/.well-known\security.txt`, opts, 200},
+
+		// Globs don't match nested dotfiles.
+		{"/.well-known/x", DotfilesOptions{Allow: []string{"/.well-known/*"}}, 200},
+		{"/.well-known/.htpasswd", DotfilesOptions{Allow: []string{"/.well-known/*"}}, 404},
+		{"/.well-known/.htpasswd", DotfilesOptions{Allow: []string{"/.well-known/.*"}}, 200},
+		{"/.env.local", DotfilesOptions{Allow: []string{"/.env*"}}, 200},
+		{"/a/.env", DotfilesOptions{Allow: []string{"/*/.env"}}, 404},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.request, nil)
+			if err != nil {
+				t.Fatalf("cannot make request: %v", err)
+			}
+
+			rr := test.HTTP(t, req, BlockDotfilesWithOptions(tc.opts)(handle{}))
+			if rr.Code != tc.wantCode {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", rr.Code, tc.wantCode)
+			}
+			if rr.Code != 200 && rr.Body.String() != "" {
+				t.Errorf("expected body to be empty: %#v", rr.Body.String())
+			}
+		})
+	}
+}
+
 func BenchmarkBlockDotfiles(b *testing.B) {
 	f := BlockDotfiles(handle{}).ServeHTTP
 	w := httptest.NewRecorder()
@@ -92,3 +249,16 @@ func BenchmarkBlockDotfiles(b *testing.B) {
 		f(w, r)
 	}
 }
+
+func BenchmarkBlockDotfilesWithOptions(b *testing.B) {
+	f := BlockDotfilesWithOptions(DotfilesOptions{Allow: []string{"/.well-known/"}})(handle{}).ServeHTTP
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/some/path/to/a/file", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for n := 0; n < b.N; n++ {
+		f(w, r)
+	}
+}
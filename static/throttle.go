@@ -0,0 +1,310 @@
+package static
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ThrottleOptions for Throttle. All rates are in bytes per second, and 0 means
+// unlimited.
+type ThrottleOptions struct {
+	// Rate is the maximum download rate per connection.
+	Rate int64
+
+	// GlobalRate is the maximum combined download rate of all responses
+	// through the middleware.
+	GlobalRate int64
+
+	// UploadRate is the maximum rate per connection for reading request
+	// bodies.
+	UploadRate int64
+
+	// GlobalUploadRate is the maximum combined rate for reading request
+	// bodies.
+	GlobalUploadRate int64
+
+	// Burst is the number of bytes which can be sent at once before
+	// throttling kicks in; defaults to 32K.
+	Burst int
+
+	// Rates overrides Rate and UploadRate for a request, e.g. to set per-route
+	// limits. GlobalRate and GlobalUploadRate still apply.
+	Rates func(*http.Request) (download, upload int64)
+}
+
+// Helper functions to make it easier to test.
+var (
+	now   = func() time.Time { return time.Now() }
+	sleep = func(ctx context.Context, d time.Duration) error {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			return nil
+		}
+	}
+)
+
+// Throttle limits the bandwidth of responses and request bodies with token
+// buckets, per connection and globally. Use a separate Throttle for routes
+// which should have their own global limit:
+//
+//	mux.Handle("/downloads/", static.Throttle(static.ThrottleOptions{
+//	    Rate:       1 << 20, // 1M/s per connection
+//	    GlobalRate: 50 << 20,
+//	})(static.FileServer("/srv/downloads", static.Options{})))
+//
+// Only the body is throttled, so the headers of Range requests and
+// conditional requests are sent right away, and a resumed download gets the
+// same rate for just the remaining bytes.
+//
+// The response is flushed before waiting, so the client receives data at a
+// steady rate. Responses which fit in the Burst are never flushed early, so
+// they keep their Content-Length. Handlers can still call Flush, and writes
+// return the context error if the client goes away while waiting.
+func Throttle(opts ThrottleOptions) func(http.Handler) http.Handler {
+	if opts.Burst <= 0 {
+		opts.Burst = 32 << 10
+	}
+	t := &throttle{
+		opts:     opts,
+		download: newBucket(opts.GlobalRate, opts.Burst),
+		upload:   newBucket(opts.GlobalUploadRate, opts.Burst),
+		conns:    make(map[connKey]*connBucket),
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			down, up := opts.Rate, opts.UploadRate
+			if opts.Rates != nil {
+				down, up = opts.Rates(r)
+			}
+
+			ctx := r.Context()
+			if dl := t.limiter(ctx, r.RemoteAddr, false, down, t.download); dl != nil {
+				defer t.release(dl)
+				w = &throttleWriter{ResponseWriter: w, l: dl}
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				if ul := t.limiter(ctx, r.RemoteAddr, true, up, t.upload); ul != nil {
+					defer t.release(ul)
+					r2 := new(http.Request)
+					*r2 = *r
+					r2.Body = &throttleReader{ReadCloser: r.Body, l: ul}
+					r = r2
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type throttle struct {
+	opts             ThrottleOptions
+	download, upload *bucket
+
+	mu    sync.Mutex
+	conns map[connKey]*connBucket
+}
+
+// connKey identifies a connection bucket; RemoteAddr includes the port, so
+// it's unique for every connection. Concurrent requests on a HTTP/2 connection
+// share the bucket if they have the same rate.
+type connKey struct {
+	addr   string
+	upload bool
+	rate   int64
+}
+
+type connBucket struct {
+	*bucket
+	refs int
+}
+
+// limiter gets the limiter for a request, or nil if it's unlimited.
+func (t *throttle) limiter(ctx context.Context, addr string, upload bool, rate int64, global *bucket) *limiter {
+	if rate <= 0 && global == nil {
+		return nil
+	}
+	l := &limiter{ctx: ctx, chunk: t.opts.Burst, global: global}
+	if rate > 0 {
+		l.key = connKey{addr: addr, upload: upload, rate: rate}
+		t.mu.Lock()
+		cb, ok := t.conns[l.key]
+		if !ok {
+			cb = &connBucket{bucket: newBucket(rate, t.opts.Burst)}
+			t.conns[l.key] = cb
+		}
+		cb.refs++
+		t.mu.Unlock()
+		l.conn = cb.bucket
+	}
+	return l
+}
+
+// release the connection bucket once no requests use it.
+func (t *throttle) release(l *limiter) {
+	if l.conn == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cb := t.conns[l.key]
+	cb.refs--
+	if cb.refs == 0 {
+		delete(t.conns, l.key)
+	}
+}
+
+// limiter throttles one direction of a request.
+type limiter struct {
+	ctx          context.Context
+	chunk        int
+	key          connKey
+	conn, global *bucket
+}
+
+// wait until n bytes can be sent. The before function is called if it needs
+// to wait.
+func (l *limiter) wait(n int, before func()) error {
+	d := l.conn.reserve(n)
+	if g := l.global.reserve(n); g > d {
+		d = g
+	}
+	if d <= 0 {
+		return nil
+	}
+	if before != nil {
+		before()
+	}
+	if err := sleep(l.ctx, d); err != nil {
+		l.conn.cancel(n)
+		l.global.cancel(n)
+		return err
+	}
+	return nil
+}
+
+// bucket is a token bucket; it's safe to use a nil bucket, which is unlimited.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64, burst int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: now()}
+}
+
+// reserve takes n tokens, and gets how long to wait before they can be used.
+func (b *bucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := now()
+	b.tokens += t.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = t
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns n unused tokens.
+func (b *bucket) cancel(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// throttleWriter throttles the response body.
+//
+// This doesn't implement io.ReaderFrom, so http.ServeContent can't bypass it
+// with sendfile.
+type throttleWriter struct {
+	http.ResponseWriter
+	l       *limiter
+	written bool
+}
+
+func (w *throttleWriter) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		c := b
+		if len(c) > w.l.chunk {
+			c = c[:w.l.chunk]
+		}
+
+		var flush func()
+		if w.written {
+			flush = w.Flush
+		}
+		if err := w.l.wait(len(c), flush); err != nil {
+			return n, err
+		}
+
+		m, err := w.ResponseWriter.Write(c)
+		n += m
+		w.written = true
+		if err != nil {
+			return n, err
+		}
+		b = b[len(c):]
+	}
+	return n, nil
+}
+
+// Flush implements http.Flusher.
+func (w *throttleWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController.
+func (w *throttleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// throttleReader throttles the request body.
+type throttleReader struct {
+	io.ReadCloser
+	l *limiter
+}
+
+func (r *throttleReader) Read(p []byte) (int, error) {
+	if len(p) > r.l.chunk {
+		p = p[:r.l.chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := r.l.wait(n, nil); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,179 @@
+package static
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// fakeClock replaces now and sleep, and records the total time slept.
+func fakeClock(t *testing.T) *time.Duration {
+	t.Helper()
+	var (
+		clock = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		slept time.Duration
+	)
+	origNow, origSleep := now, sleep
+	now = func() time.Time { return clock }
+	sleep = func(ctx context.Context, d time.Duration) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		clock = clock.Add(d)
+		slept += d
+		return nil
+	}
+	t.Cleanup(func() { now, sleep = origNow, origSleep })
+	return &slept
+}
+
+func TestThrottle(t *testing.T) {
+	body := strings.Repeat("x", 400)
+	write := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	})
+
+	cases := []struct {
+		name      string
+		opts      ThrottleOptions
+		addrs     []string
+		target    string
+		wantSlept time.Duration
+	}{
+		{"unlimited", ThrottleOptions{Burst: 100}, []string{"1:1"}, "/", 0},
+		{"per connection", ThrottleOptions{Rate: 100, Burst: 100}, []string{"1:1"}, "/", 3 * time.Second},
+		{"per connection, two connections", ThrottleOptions{Rate: 100, Burst: 100},
+			[]string{"1:1", "1:2"}, "/", 6 * time.Second},
+		{"global", ThrottleOptions{GlobalRate: 100, Burst: 100},
+			[]string{"1:1", "1:2"}, "/", 7 * time.Second},
+		{"global is lower", ThrottleOptions{Rate: 200, GlobalRate: 100, Burst: 100},
+			[]string{"1:1"}, "/", 3 * time.Second},
+		{"rates", ThrottleOptions{Rate: 100, Burst: 100, Rates: func(r *http.Request) (int64, int64) {
+			if r.URL.Path == "/free" {
+				return 0, 0
+			}
+			return 50, 0
+		}}, []string{"1:1"}, "/free", 0},
+		{"rates slow", ThrottleOptions{Rate: 100, Burst: 100, Rates: func(r *http.Request) (int64, int64) {
+			return 50, 0
+		}}, []string{"1:1"}, "/", 6 * time.Second},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			slept := fakeClock(t)
+			h := Throttle(tc.opts)(write)
+			for _, addr := range tc.addrs {
+				req := httptest.NewRequest("GET", tc.target, nil)
+				req.RemoteAddr = addr
+				rr := httptest.NewRecorder()
+				h.ServeHTTP(rr, req)
+				if rr.Body.String() != body {
+					t.Errorf("wrong body: %d bytes", rr.Body.Len())
+				}
+			}
+			if *slept != tc.wantSlept {
+				t.Errorf("slept %s; want %s", *slept, tc.wantSlept)
+			}
+		})
+	}
+}
+
+func TestThrottleFlush(t *testing.T) {
+	fakeClock(t)
+	h := Throttle(ThrottleOptions{Rate: 100, Burst: 100})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("x", len(r.URL.Path))))
+		if r.URL.Query().Get("flush") != "" {
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	cases := []struct {
+		target      string
+		wantFlushed bool
+	}{
+		{"/", false},
+		{"/" + strings.Repeat("x", 99), false},
+		{"/" + strings.Repeat("x", 100), true},
+		{"/?flush=1", true},
+	}
+	for _, tc := range cases {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", tc.target, nil))
+		if rr.Flushed != tc.wantFlushed {
+			t.Errorf("%s: flushed is %t", tc.target, rr.Flushed)
+		}
+	}
+}
+
+func TestThrottleRange(t *testing.T) {
+	slept := fakeClock(t)
+	h := Throttle(ThrottleOptions{Rate: 100, Burst: 100})(FileServerFS(fstest.MapFS{
+		"file.bin": {Data: []byte(strings.Repeat("x", 1000))},
+	}, Options{}))
+
+	req := httptest.NewRequest("GET", "/file.bin", nil)
+	req.Header.Set("Range", "bytes=850-")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPartialContent || rr.Body.Len() != 150 ||
+		rr.Header().Get("Content-Range") != "bytes 850-999/1000" {
+		t.Errorf("wrong response: %d %d %v", rr.Code, rr.Body.Len(), rr.Header())
+	}
+	if *slept != 500*time.Millisecond {
+		t.Errorf("slept %s", *slept)
+	}
+}
+
+func TestThrottleUpload(t *testing.T) {
+	slept := fakeClock(t)
+	var got []byte
+	h := Throttle(ThrottleOptions{UploadRate: 100, Burst: 100})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		_, _ = w.Write(got)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 300))))
+	if len(got) != 300 || rr.Body.Len() != 300 {
+		t.Errorf("wrong body: %d %d", len(got), rr.Body.Len())
+	}
+	if *slept != 2*time.Second {
+		t.Errorf("slept %s", *slept)
+	}
+}
+
+func TestThrottleCancel(t *testing.T) {
+	fakeClock(t)
+	var (
+		n   int
+		err error
+	)
+	th := Throttle(ThrottleOptions{GlobalRate: 100, Burst: 100})
+	h := th(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err = w.Write([]byte(strings.Repeat("x", 300)))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if n != 100 || err != context.Canceled {
+		t.Errorf("wrong result: %d %v", n, err)
+	}
+
+	// The cancelled bytes are returned to the global bucket, so the next
+	// request only waits for the first 100 bytes.
+	slept := fakeClock(t)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Body.Len() != 300 || *slept != 3*time.Second {
+		t.Errorf("wrong result: %d %s", rr.Body.Len(), *slept)
+	}
+}